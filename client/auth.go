@@ -0,0 +1,138 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With --join_secret every announcement carries ts, addrs and hmac TXT keys, where hmac is
+// HMAC-SHA256(secret, "uuid|addrs|peer port|client port|role|ts"). A long address list continues in
+// addrs1, addrs2...; addrs is signed as the whole list. A peer is only accepted if the MAC
+// verifies, the address we saw it on is one it signed, and it is not older than the last
+// announcement we accepted from the same uuid. Booting announcements are re-signed every poll and
+// must also be recent. A server's (or proxy's) announcement outlives us in the avahi service file,
+// so it has no age limit; it is still bound to the addresses it signed.
+
+// booting announcements older than this are replays
+const announcementMaxAge = 60 * time.Second
+
+// re-sign well before the signature ages out
+const announcementRefresh = 15 * time.Second
+
+func announcementMAC(secret string, uuid string, addrs string, peerPort int, clientPort int, role string, ts int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s|%s|%d|%d|%s|%d", uuid, addrs, peerPort, clientPort, role, ts)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// maxTXTString is the longest string a DNS TXT record can hold, key and '=' included
+const maxTXTString = 255
+
+// addrsTXT spreads the comma separated addresses over the keys addrs, addrs1, addrs2... so that
+// a host with many addresses still fits each key in a TXT string
+func addrsTXT(addrs []net.IP) []string {
+	txt := make([]string, 0)
+	key := "addrs"
+	current := ""
+	for _, ip := range addrs {
+		a := ip.String()
+		if current != "" && len(key)+1+len(current)+1+len(a) > maxTXTString {
+			txt = append(txt, key+"="+current)
+			key = "addrs" + strconv.Itoa(len(txt))
+			current = ""
+		}
+		if current != "" {
+			current += ","
+		}
+		current += a
+	}
+	return append(txt, key+"="+current)
+}
+
+// joinedAddrs puts back together the address list that addrsTXT split
+func joinedAddrs(txt []string) string {
+	addrs, _ := txtValue(txt, "addrs")
+	for i := 1; ; i++ {
+		more, ok := txtValue(txt, "addrs"+strconv.Itoa(i))
+		if !ok {
+			return addrs
+		}
+		addrs += "," + more
+	}
+}
+
+// signedTXT returns the TXT keys that authenticate our announcement
+func (cs *ClientState) signedTXT() []string {
+	ts := time.Now().Unix()
+	addrsKeys := addrsTXT(common.LocalAddrs())
+	mac := announcementMAC(cs.cfg.JoinSecret, cs.cfg.UUID, joinedAddrs(addrsKeys), cs.etcd.PeerPort, cs.etcd.ClientPort, cs.role, ts)
+	txt := []string{"ts=" + strconv.FormatInt(ts, 10)}
+	txt = append(txt, addrsKeys...)
+	return append(txt, "hmac="+mac)
+}
+
+// refreshAnnouncement re-publishes our TXT record so that the signature stays fresh
+func (cs *ClientState) refreshAnnouncement() {
+	if cs.cfg.JoinSecret == "" || time.Since(cs.signedAt) < announcementRefresh {
+		return
+	}
+	cs.signedAt = time.Now()
+	if cs.responder != nil {
+		cs.responder.SetText(cs.txtRecords())
+	} else if cs.cfg.MDNSPublisher != "native" {
+		cs.WriteAvahiServiceFile()
+	}
+}
+
+// checkAnnouncement verifies the signature on a peer's announcement. Only configured peers (see
+// configuredPeer) go unsigned; an mDNS entry without TXT is as unsigned as one without hmac.
+func (cs *ClientState) checkAnnouncement(ent *AvahiBrowseResult, peerIP net.IP) error {
+	if cs.cfg.JoinSecret == "" || configuredPeer(ent) {
+		return nil
+	}
+	uuid, _ := txtValue(ent.TXT, "uuid")
+	role, _ := txtValue(ent.TXT, "role")
+	addrs := joinedAddrs(ent.TXT)
+	tsString, _ := txtValue(ent.TXT, "ts")
+	mac, ok := txtValue(ent.TXT, "hmac")
+	if !ok {
+		return fmt.Errorf("peer '%s' announcement is not signed", ent.Name)
+	}
+	ts, err := strconv.ParseInt(tsString, 10, 64)
+	if err != nil {
+		return fmt.Errorf("peer '%s' announcement has invalid timestamp '%s'", ent.Name, tsString)
+	}
+	clientPort := cs.etcd.ClientPort
+	if v, ok := txtValue(ent.TXT, "client_port"); ok {
+		clientPort, _ = strconv.Atoi(v)
+	}
+	expected := announcementMAC(cs.cfg.JoinSecret, uuid, addrs, ent.Port, clientPort, role, ts)
+	if !hmac.Equal([]byte(mac), []byte(expected)) {
+		return fmt.Errorf("peer '%s' announcement signature does not verify", ent.Name)
+	}
+
+	signedAddr := false
+	for _, a := range strings.Split(addrs, ",") {
+		signedAddr = signedAddr || peerIP.Equal(net.ParseIP(a))
+	}
+	if !signedAddr {
+		return fmt.Errorf("peer '%s' seen on %s, which it did not sign for", ent.Name, peerIP.String())
+	}
+	age := time.Since(time.Unix(ts, 0))
+	persistent := role == roleServer || role == roleProxy
+	if (age > announcementMaxAge && !persistent) || age < -announcementMaxAge {
+		return fmt.Errorf("peer '%s' announcement timestamp is %s out", ent.Name, age.String())
+	}
+	if last, ok := cs.signedTimes[uuid]; ok && ts < last {
+		return fmt.Errorf("peer '%s' announcement is older than one already seen; replayed?", ent.Name)
+	}
+	cs.signedTimes[uuid] = ts
+	return nil
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testSecret = "s3cret"
+
+var testAddrs = []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")}
+
+// signedAnnouncement is the TXT a peer with uuid would publish with role at ts
+func signedAnnouncement(secret string, uuid string, signedRole string, role string, ts time.Time) []string {
+	return signedAnnouncementFrom(secret, uuid, signedRole, role, ts, testAddrs)
+}
+
+func signedAnnouncementFrom(secret string, uuid string, signedRole string, role string, ts time.Time, addrs []net.IP) []string {
+	unix := ts.Unix()
+	addrsKeys := addrsTXT(addrs)
+	mac := announcementMAC(secret, uuid, joinedAddrs(addrsKeys), 7001, 4001, signedRole, unix)
+	txt := []string{
+		"role=" + role,
+		"uuid=" + uuid,
+		"client_port=4001",
+		"ts=" + strconv.FormatInt(unix, 10),
+	}
+	txt = append(txt, addrsKeys...)
+	return append(txt, "hmac="+mac)
+}
+
+func newAuthTestState() *ClientState {
+	return newTestState(&common.Config{JoinSecret: testSecret}, &common.EtcdConfig{PeerPort: 7001, ClientPort: 4001})
+}
+
+func TestCheckAnnouncement(t *testing.T) {
+	now := time.Now()
+	stale := now.Add(-2 * announcementMaxAge)
+	longAgo := now.Add(-30 * 24 * time.Hour)
+	peerIP := net.ParseIP("10.0.0.2")
+	tests := []struct {
+		name    string
+		source  string
+		txt     []string
+		peerIP  net.IP
+		wantErr bool
+	}{
+		{name: "fresh booting", source: "mdns", txt: signedAnnouncement(testSecret, "u1", roleBooting, roleBooting, now)},
+		{name: "stale booting", source: "mdns", txt: signedAnnouncement(testSecret, "u1", roleBooting, roleBooting, stale), wantErr: true},
+		{name: "server past max age", source: "avahi", txt: signedAnnouncement(testSecret, "u1", roleServer, roleServer, stale)},
+		{name: "server from a month ago", source: "mdns", txt: signedAnnouncement(testSecret, "u1", roleServer, roleServer, longAgo)},
+		{name: "proxy past max age", source: "mdns", txt: signedAnnouncement(testSecret, "u1", roleProxy, roleProxy, stale)},
+		{name: "stale booting relabelled server", source: "mdns", txt: signedAnnouncement(testSecret, "u1", roleBooting, roleServer, stale), wantErr: true},
+		{name: "from the future", source: "mdns", txt: signedAnnouncement(testSecret, "u1", roleServer, roleServer, now.Add(2*announcementMaxAge)), wantErr: true},
+		{name: "wrong secret", source: "mdns", txt: signedAnnouncement("guess", "u1", roleServer, roleServer, now), wantErr: true},
+		{name: "unsigned address", source: "mdns", txt: signedAnnouncement(testSecret, "u1", roleServer, roleServer, now), peerIP: net.ParseIP("10.0.0.66"), wantErr: true},
+		{name: "no hmac", source: "udp", txt: []string{"role=server", "uuid=u1"}, wantErr: true},
+		{name: "no TXT from mdns", source: "mdns", txt: nil, wantErr: true},
+		{name: "no TXT from avahi", source: "avahi", txt: nil, wantErr: true},
+		{name: "static seed", source: "static", txt: nil},
+		{name: "SRV record", source: "srv", txt: nil},
+	}
+	for _, tt := range tests {
+		ip := peerIP
+		if tt.peerIP != nil {
+			ip = tt.peerIP
+		}
+		ent := &AvahiBrowseResult{Name: "u1", Port: 7001, Source: tt.source, TXT: tt.txt}
+		err := newAuthTestState().checkAnnouncement(ent, ip)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkAnnouncement returned %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// a booting node sees a server founded an hour ago, whose avahi service file has not changed since
+func TestCheckAnnouncementReplay(t *testing.T) {
+	cs := newAuthTestState()
+	peerIP := net.ParseIP("10.0.0.2")
+	founded := time.Now().Add(-time.Hour)
+	server := &AvahiBrowseResult{Name: "u1", Port: 7001, Source: "avahi", TXT: signedAnnouncement(testSecret, "u1", roleServer, roleServer, founded)}
+	for i := 0; i < 3; i++ {
+		if err := cs.checkAnnouncement(server, peerIP); err != nil {
+			t.Fatalf("sighting %d of a long-running server: %s", i, err.Error())
+		}
+	}
+	older := &AvahiBrowseResult{Name: "u1", Port: 7001, Source: "avahi", TXT: signedAnnouncement(testSecret, "u1", roleServer, roleServer, founded.Add(-time.Minute))}
+	if err := cs.checkAnnouncement(older, peerIP); err == nil {
+		t.Errorf("an announcement older than one already seen verified")
+	}
+}
+
+// a host with more addresses than fit in one TXT string
+func TestCheckAnnouncementManyAddrs(t *testing.T) {
+	addrs := make([]net.IP, 0)
+	for i := 0; i < 60; i++ {
+		addrs = append(addrs, net.ParseIP(fmt.Sprintf("fd00:1234:5678:9abc:def0:%x::%x", i, i+1)))
+	}
+	txt := signedAnnouncementFrom(testSecret, "u1", roleServer, roleServer, time.Now(), addrs)
+	keys := 0
+	for _, s := range txt {
+		if len(s) > maxTXTString {
+			t.Errorf("TXT string of %d bytes: %s", len(s), s)
+		}
+		if strings.HasPrefix(s, "addrs") {
+			keys++
+		}
+	}
+	if keys < 2 {
+		t.Errorf("%d addresses fit in %d addrs keys; the test needs more", len(addrs), keys)
+	}
+	// the record must pack, which it does not with a string over 255 bytes
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartAnswers()
+	name := dnsmessage.MustNewName("u1._scriptrock_etcd._tcp.local.")
+	if err := b.TXTResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET}, dnsmessage.TXTResource{TXT: txt}); err != nil {
+		t.Errorf("packing the TXT record: %s", err.Error())
+	}
+
+	if got := joinedAddrs(txt); got != joinedAddrs(addrsTXT(addrs)) || strings.Count(got, ",") != len(addrs)-1 {
+		t.Errorf("joined addresses '%s', want all %d", got, len(addrs))
+	}
+	cs := newAuthTestState()
+	for _, ip := range []net.IP{addrs[0], addrs[len(addrs)-1]} {
+		ent := &AvahiBrowseResult{Name: "u1", Port: 7001, Source: "mdns", TXT: txt}
+		if err := cs.checkAnnouncement(ent, ip); err != nil {
+			t.Errorf("seen on %s: %s", ip.String(), err.Error())
+		}
+	}
+	// dropping a continuation key breaks the signature
+	truncated := append(append([]string{}, txt[:len(txt)-2]...), txt[len(txt)-1])
+	ent := &AvahiBrowseResult{Name: "u1", Port: 7001, Source: "mdns", TXT: truncated}
+	if err := newAuthTestState().checkAnnouncement(ent, addrs[0]); err == nil {
+		t.Errorf("announcement missing an addrs key verified")
+	}
+}
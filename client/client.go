@@ -13,13 +13,17 @@ By Mark Sheahan, ScriptRock Inc
 */
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/ScriptRock/peerdiscovery/common"
+	"github.com/ScriptRock/peerdiscovery/mdns"
+	"html"
 	"io/ioutil"
 	"net"
-	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
@@ -49,28 +53,71 @@ type AvahiBrowseResult struct {
 	IPv6          net.IP
 	PortString    string // 12346
 	Port          int
+	TXT           []string // key=value strings, where the backend provides them
+	Source        string   // discovery backend that produced this entry
 }
 
 type ClientState struct {
-	cfg                   *common.Config
-	etcd                  *common.EtcdConfig
-	mdnsPeerServerEntries chan *AvahiBrowseResult
-	discoveryURL          chan string
-	pollEvent             chan int
+	cfg            *common.Config
+	etcd           *common.EtcdConfig
+	discoverers    []Discoverer
+	peerCandidates chan *AvahiBrowseResult
+	discoveryURL   chan string
+	pollEvent      chan int
+	responder      *mdns.Responder
+	role           string
+	signedAt       time.Time
+	signedTimes    map[string]int64 // latest accepted signed timestamp, by uuid
+	election       ElectionStrategy
+	transport      handshakeTransport
+	proposalSeen   chan bool
+	handshakeInbox chan *handshakeMessage
+	ca             *certAuthority
+	prober         *prober
+	echoListener   net.Listener
+	watching       chan bool // closed once bootstrap is over in --daemon mode
 }
 
-func newClientState(cfg *common.Config, etcd *common.EtcdConfig) *ClientState {
+func newClientState(cfg *common.Config, etcd *common.EtcdConfig, discoverers []Discoverer) *ClientState {
 	return &ClientState{
-		cfg:  cfg,
-		etcd: etcd,
-		mdnsPeerServerEntries: make(chan *AvahiBrowseResult),
-		discoveryURL:          make(chan string, 2),
-		pollEvent:             make(chan int),
+		cfg:            cfg,
+		etcd:           etcd,
+		discoverers:    discoverers,
+		peerCandidates: make(chan *AvahiBrowseResult),
+		discoveryURL:   make(chan string, 2),
+		pollEvent:      make(chan int, 1),
+		role:           roleBooting,
+		prober:         newProber(cfg, etcd),
+		signedTimes:    make(map[string]int64),
+		watching:       make(chan bool),
+	}
+}
+
+// addIP records one of the peer's addresses, keeping at most one of each family. For IPv6 a
+// global address wins over a link-local one.
+func (a *AvahiBrowseResult) addIP(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	if a.IPString == "" {
+		a.IPString = ip.String()
+		if ip.To4() == nil {
+			a.Protocol = "IPv6"
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if a.IPv4 == nil {
+			a.IPv4 = ip4
+		}
+	} else if a.IPv6 == nil || (common.IsIPv6LinkLocal(a.IPv6) && !common.IsIPv6LinkLocal(ip)) {
+		a.IPv6 = ip
 	}
 }
 
 func parseAvahiBrowse(data []byte) []*AvahiBrowseResult {
 	results := make([]*AvahiBrowseResult, 0)
+	// avahi resolves once per protocol; merge those so that each instance has both addresses
+	byInstance := make(map[string]*AvahiBrowseResult)
 	lines := regexp.MustCompile("\\r?\\n").Split(string(data), -1)
 	for _, line := range lines {
 		fields := regexp.MustCompile(";").Split(line, -1)
@@ -88,22 +135,37 @@ func parseAvahiBrowse(data []byte) []*AvahiBrowseResult {
 				IPv6:          nil,
 				PortString:    fields[8],
 				Port:          0,
+				Source:        "avahi",
 			}
 			if v, err := strconv.Atoi(a.PortString); err == nil {
 				a.Port = v
 			}
-			if a.Protocol == "IPv4" {
-				a.IPv4 = net.ParseIP(a.IPString)
+			key := a.InterfaceName + ";" + a.Name + ";" + a.Service + ";" + a.Domain
+			if existing, ok := byInstance[key]; ok {
+				existing.addIP(net.ParseIP(a.IPString))
+				continue
 			}
-			if a.Protocol == "IPv6" {
-				a.IPv6 = net.ParseIP(a.IPString)
+			a.addIP(net.ParseIP(a.IPString))
+			if len(fields) >= 10 {
+				a.TXT = parseAvahiTXT(fields[9])
 			}
+			byInstance[key] = a
 			results = append(results, a)
 		}
 	}
 	return results
 }
 
+// parseAvahiTXT splits avahi-browse's TXT field, which is a space separated list of quoted strings:
+// "role=booting" "txtvers=1"
+func parseAvahiTXT(field string) []string {
+	txt := make([]string, 0)
+	for _, m := range regexp.MustCompile(`"([^"]*)"`).FindAllStringSubmatch(field, -1) {
+		txt = append(txt, m[1])
+	}
+	return txt
+}
+
 func avahiPrefix() string {
 	wrapperPath := ""
 
@@ -165,7 +227,146 @@ func runAvahiBrowse(service string, results chan *AvahiBrowseResult) {
 	}
 }
 
+func avahiResultFromEntry(e *mdns.Entry) *AvahiBrowseResult {
+	a := &AvahiBrowseResult{
+		Type:          "=",
+		InterfaceName: e.InterfaceName,
+		Protocol:      "IPv4",
+		Name:          e.Instance,
+		Service:       e.Service,
+		Domain:        e.Domain,
+		Host:          e.Host,
+		PortString:    strconv.Itoa(e.Port),
+		Port:          e.Port,
+		TXT:           e.Text,
+		Source:        "mdns",
+	}
+	a.addIP(e.IPv4)
+	a.addIP(e.IPv6)
+	return a
+}
+
+func runNativeBrowse(service string, domain string, timeout time.Duration, results chan *AvahiBrowseResult) {
+	entries := make(chan *mdns.Entry)
+	go func() {
+		if err := mdns.Browse(service, domain, timeout, entries); err != nil {
+			fmt.Printf("Error running mDNS browse for '%s': %s\n", service, err.Error())
+		}
+		close(entries)
+	}()
+	for e := range entries {
+		results <- avahiResultFromEntry(e)
+	}
+}
+
+// roles published in the "role" TXT key
+const (
+	roleBooting = "booting"
+	roleServer  = "server"
+	roleProxy   = "proxy"
+)
+
+// version of the TXT keys below, published as "proto"
+const txtProtoVersion = 1
+
+// txtRecords is what we publish about ourselves in the DNS-SD TXT record
+func (cs *ClientState) txtRecords() []string {
+	txt := []string{
+		"txtvers=1",
+		"proto=" + strconv.Itoa(txtProtoVersion),
+		"role=" + cs.role,
+		"uuid=" + cs.cfg.UUID,
+		"client_port=" + strconv.Itoa(cs.etcd.ClientPort),
+	}
+	if cs.etcd.ClusterID != "" {
+		txt = append(txt, "cluster_id="+cs.etcd.ClusterID)
+	}
+	if cs.cfg.Priority != 0 {
+		txt = append(txt, "priority="+strconv.Itoa(cs.cfg.Priority))
+	}
+	if cs.cfg.ClusterName != "" {
+		txt = append(txt, "cluster="+cs.cfg.ClusterName)
+	}
+	if cs.cfg.JoinToken != "" {
+		txt = append(txt, "join_token="+joinTokenHash(cs.cfg.JoinToken))
+	}
+	if cs.cfg.EchoPort != 0 {
+		txt = append(txt, "echo_port="+strconv.Itoa(cs.cfg.EchoPort))
+	}
+	if cs.cfg.JoinSecret != "" {
+		txt = append(txt, cs.signedTXT()...)
+	}
+	return txt
+}
+
+// subtypes lets tools browse for just our cluster, e.g. _prod._sub._scriptrock_etcd._tcp
+func (cs *ClientState) subtypes() []string {
+	if cs.cfg.ClusterName == "" {
+		return []string{}
+	}
+	return []string{"_" + cs.cfg.ClusterName}
+}
+
+// joinTokenHash is published in place of the join token itself, which is a shared secret
+func joinTokenHash(token string) string {
+	sum := sha256.Sum256([]byte("peerdiscovery join token:" + token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// configuredPeer is true for entries from backends the operator points at explicitly (static
+// seeds, DNS SRV), which carry no TXT. Anything else may come from any host on the LAN.
+func configuredPeer(ent *AvahiBrowseResult) bool {
+	return ent.Source == "static" || ent.Source == "srv"
+}
+
+// checkCluster rejects peers that belong to another cluster on the same LAN. Configured peers are
+// trusted to be in ours. An announcement without TXT, which an mDNS responder that never answers
+// for TXT leaves us with, can only be in the default unnamed cluster.
+func (cs *ClientState) checkCluster(ent *AvahiBrowseResult) error {
+	if configuredPeer(ent) {
+		return nil
+	}
+	if ent.TXT == nil {
+		if cs.cfg.ClusterName != "" || cs.cfg.JoinToken != "" {
+			return fmt.Errorf("peer '%s' publishes no cluster or join token; not ours", ent.Name)
+		}
+		return nil
+	}
+	cluster, _ := txtValue(ent.TXT, "cluster")
+	if cluster != cs.cfg.ClusterName {
+		return fmt.Errorf("peer '%s' is in cluster '%s', not ours ('%s')", ent.Name, cluster, cs.cfg.ClusterName)
+	}
+	token, _ := txtValue(ent.TXT, "join_token")
+	ourToken := ""
+	if cs.cfg.JoinToken != "" {
+		ourToken = joinTokenHash(cs.cfg.JoinToken)
+	}
+	if token != ourToken {
+		return fmt.Errorf("peer '%s' in cluster '%s' has a different join token", ent.Name, cluster)
+	}
+	return nil
+}
+
+// txtValue returns the value of key from key=value TXT strings
+func txtValue(txt []string, key string) (string, bool) {
+	for _, t := range txt {
+		if strings.HasPrefix(t, key+"=") {
+			return t[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
 func (cs *ClientState) WriteAvahiServiceFile() {
+	// avahi-service.dtd wants subtypes between type and port, and TXT records last
+	subtypes := ""
+	for _, s := range cs.subtypes() {
+		subtypes += fmt.Sprintf("    <subtype>%s._sub.%s</subtype>\n", html.EscapeString(s), cs.cfg.MDNSService)
+	}
+	txtRecords := ""
+	for _, t := range cs.txtRecords() {
+		txtRecords += fmt.Sprintf("    <txt-record>%s</txt-record>\n", html.EscapeString(t))
+	}
 	// wrap each peer in quotes
 	conf := fmt.Sprintf(
 		`<?xml version="1.0" standalone='no'?><!--*-nxml-*-->
@@ -174,13 +375,15 @@ func (cs *ClientState) WriteAvahiServiceFile() {
   <name>%s</name>
   <service>
     <type>%s</type>
-    <port>%d</port>
-  </service>
+%s    <port>%d</port>
+%s  </service>
 </service-group>
 `,
 		cs.cfg.UUID,
 		cs.cfg.MDNSService,
-		cs.etcd.PeerPort)
+		subtypes,
+		cs.etcd.PeerPort,
+		txtRecords)
 
 	fmt.Printf("Writing avahi conf file to '%s'\n", cs.cfg.AvahiConfPath)
 	if err := ioutil.WriteFile(cs.cfg.AvahiConfPath, []byte(conf), 0644); err != nil {
@@ -188,31 +391,95 @@ func (cs *ClientState) WriteAvahiServiceFile() {
 	}
 }
 
+func (cs *ClientState) startResponder() error {
+	cs.responder = mdns.NewResponder(mdns.Service{
+		Instance: cs.cfg.MDNSInstance,
+		Service:  cs.cfg.MDNSService,
+		Domain:   cs.cfg.MDNSDomain,
+		Host:     cs.cfg.UUID,
+		Port:     cs.etcd.PeerPort,
+		Text:     cs.txtRecords(),
+		Subtypes: cs.subtypes(),
+	})
+	if err := cs.responder.Start(); err != nil {
+		cs.responder = nil
+		return err
+	}
+	fmt.Printf("mDNS responder announcing '%s' as '%s'\n", cs.cfg.MDNSService, cs.responder.Instance())
+
+	// send goodbyes if we are killed part way through
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cs.stopResponder()
+		os.Exit(1)
+	}()
+	return nil
+}
+
+func (cs *ClientState) stopResponder() {
+	if cs.responder != nil {
+		cs.responder.Shutdown()
+	}
+}
+
 func (cs *ClientState) pollLoop() {
 	for {
-		runAvahiBrowse(cs.cfg.MDNSService, cs.mdnsPeerServerEntries)
+		cs.refreshAnnouncement()
+		// run each backend in order to see nearby things
+		// once watching, a settled backend no longer stops the others from being polled
+		for _, d := range cs.discoverers {
+			if d.Poll(cs) && !cs.isWatching() {
+				fmt.Printf("Discovery settled by '%s' backend\n", d.Name())
+				if !cs.cfg.Daemon {
+					return
+				}
+				break
+			}
+		}
 
-		// run avahi browse to see nearby things
-		cs.pollEvent <- 0
+		// stateTask may be busy; a poll it has not picked up yet counts for this one too
+		select {
+		case cs.pollEvent <- 0:
+		default:
+		}
 		time.Sleep(cs.cfg.PollInterval)
 	}
 }
 
 func (cs *ClientState) checkEnt(ent *AvahiBrowseResult) (*net.Interface, net.IP, net.IP, error, error) {
-	// only use IPv4
-	peerIP := ent.IPv4
+	// one address per peer, in the configured family, so that every node sees the same one
+	peerIP := cs.etcd.PickAddr(ent.IPv4, ent.IPv6)
 	if peerIP == nil {
-		return nil, nil, nil, fmt.Errorf("No IPv4 address present"), nil
+		return nil, nil, nil, fmt.Errorf("No address present for address family '%s'", cs.etcd.AddrFamily), nil
+	}
+	zone := ""
+	if common.IsIPv6LinkLocal(peerIP) {
+		if ent.InterfaceName == "" {
+			return nil, nil, nil, fmt.Errorf("Link-local address %s without an interface", peerIP.String()), nil
+		}
+		zone = ent.InterfaceName
 	}
-	// This technically restricts valid configurations that go through routers. Will need to re-visit.
-	// The objective is to prevent NATs where the return path will not work, not routers where the return path will.
-	// Eventually, must set up a tcp/http server on the destination host that echoes back the connecting IP address,
-	// and compare against that.
+	// Peers on a directly connected subnet can always reach us back. Peers beyond a router are
+	// left with no local address here, and the probe pool checks their echo endpoint first: the
+	// objective is to reject NATs, where the return path will not work, not routers, where it will.
 	// There is also an issue with multiple addresses on the same subnet on the same interface; but this is dumb anyway
-	iface, _, myIP, err := common.LocalNetForIp(peerIP)
+	iface, _, myIP, err := common.LocalNetForZonedIp(peerIP, zone)
 	if err == nil && myIP.Equal(peerIP) {
 		return nil, nil, nil, fmt.Errorf("IP address is self (%s = %s)", myIP.String(), peerIP.String()), nil
 	}
+	if err != nil && cs.cfg.EchoPort != 0 && zone == "" {
+		err = nil
+	} else if err == nil {
+		// a peer we would reach through an address we may not use is no peer of ours
+		if err = cs.etcd.CheckAddrPolicy(iface, myIP); err != nil {
+			return nil, nil, nil, fmt.Errorf("Peer %s reached from %s: %s", peerIP.String(), myIP.String(), err.Error()), nil
+		}
+	}
+	if cs.ownInstance(ent.Name) {
+		return nil, nil, nil, fmt.Errorf("Instance '%s' is our own announcement", ent.Name), nil
+	}
 	if strings.HasPrefix(ent.Name, cs.cfg.UUID) {
 		// This is bad; duplicate UUID from someone that isn't us. Presumably caused by a cloned VM.
 		// In this case, panic, delete old id, die, and on the next respawn we'll regenerate the id
@@ -220,9 +487,25 @@ func (cs *ClientState) checkEnt(ent *AvahiBrowseResult) (*net.Interface, net.IP,
 		fatalErr := fmt.Errorf("Prefix UUID is from self")
 		return nil, nil, nil, fatalErr, fatalErr
 	}
+	if err := cs.checkCluster(ent); err != nil {
+		return nil, nil, nil, err, nil
+	}
+	if err := cs.checkAnnouncement(ent, peerIP); err != nil {
+		return nil, nil, nil, err, nil
+	}
 	return iface, myIP, peerIP, err, nil
 }
 
+// ownInstance reports whether name is an instance we announce. Unlike avahi-browse --ignore-local,
+// the native browser hears our own announcement, which must not be taken for a cloned UUID.
+// The responder may have renamed us after a conflict, so its current name counts too.
+func (cs *ClientState) ownInstance(name string) bool {
+	if cs.responder != nil && name == cs.responder.Instance() {
+		return true
+	}
+	return name == cs.cfg.UUID || name == cs.cfg.MDNSInstance
+}
+
 func (cs *ClientState) peerMDNSHostname(ent *AvahiBrowseResult) string {
 	return ent.Name
 }
@@ -232,6 +515,10 @@ func (cs *ClientState) stateTask() (errOut error) {
 	lastPollWithHigherPeer := 0
 	finished := false
 	errOut = nil
+	expectDeadline := time.Now().Add(cs.cfg.ExpectWait)
+	pool := newProbePool(cs.prober, cs.cfg.ProbeWorkers)
+	defer pool.stop()
+	probing := make(map[string]bool) // peer IPs with a probe queued or running
 
 	for !finished {
 		select {
@@ -239,43 +526,72 @@ func (cs *ClientState) stateTask() (errOut error) {
 			// time to give up and write out a conf
 			polls = polls + 1
 			fmt.Printf("poll occurred\n")
-			if polls >= lastPollWithHigherPeer+cs.cfg.MaxLoops {
+			if cs.cfg.Expect > 0 {
+				seen := len(cs.seenMembers())
+				if seen >= cs.cfg.Expect {
+					fmt.Printf("%d of %d expected nodes seen\n", seen, cs.cfg.Expect)
+					finished = true
+				} else if time.Now().After(expectDeadline) {
+					fmt.Printf("Timed out with %d of %d expected nodes seen; founding with those\n", seen, cs.cfg.Expect)
+					finished = true
+				} else {
+					fmt.Printf("%d of %d expected nodes seen; waiting\n", seen, cs.cfg.Expect)
+				}
+			} else if polls >= lastPollWithHigherPeer+cs.cfg.MaxLoops {
 				fmt.Printf("%d consecutive polls with no lower peer; exiting\n", cs.cfg.MaxLoops)
 				finished = true
 			}
-		case ent := <-cs.mdnsPeerServerEntries:
+		case ent := <-cs.peerCandidates:
 			// peer etcd server. It may still be booting though.
-			// do an HTTP request to the server to see if it truly exists
+			// hand it to the probe pool to see if it truly exists
 			if iface, localIP, peerIP, err, fatalErr := cs.checkEnt(ent); fatalErr != nil {
 				finished = true
 				fmt.Printf("Fatal error from peer server entry: %s\n", err.Error())
 				errOut = fatalErr
 			} else if err != nil {
 				fmt.Println("etcd server", ent, "invalid", err)
-			} else {
-				peerMDNSHostname := cs.peerMDNSHostname(ent)
-				peerPort := ent.Port
-				fmt.Printf("etcd server mDNS response: IP %s mDNS hostname %s\n", peerIP.String(), peerMDNSHostname)
-				url := fmt.Sprintf("http://%s:%d/v2/keys/", peerIP.String(), cs.etcd.ClientPort)
-				if _, err := http.Get(url); err != nil {
-					fmt.Printf("Peer at '%s' not available yet: %s\n", url, err.Error())
-					cs.etcd.AddBootingPeer(iface, localIP, peerIP, peerPort)
-					if localIP.String() < peerIP.String() {
-						// we are lower; keep going
-					} else {
-						lastPollWithHigherPeer = polls
-					}
+			} else if !probing[peerIP.String()] {
+				c := cs.newPeerCandidate(ent, iface, localIP, peerIP)
+				fmt.Printf("etcd server %s response: IP %s mDNS hostname %s role '%s'\n", ent.Source, peerIP.String(), c.name, c.role)
+				if pool.submit(c) {
+					probing[peerIP.String()] = true
 				} else {
-					fmt.Printf("Peer etcd server found on %s (%s); exiting\n", url, peerIP)
-					cs.etcd.AddServerPeer(iface, localIP, peerIP, peerPort)
-					cs.etcd.DiscoveryURL = ""
-					finished = true
+					fmt.Printf("Probe queue full; dropping %s until the next poll\n", peerIP.String())
 				}
 			}
+		case ev := <-pool.results:
+			c := ev.candidate()
+			delete(probing, c.peerIP.String())
+			switch e := ev.(type) {
+			case *peerRejectedEvent:
+				fmt.Println("etcd server", c.ent, "invalid", e.reason)
+			case *proxyIgnoredEvent:
+				fmt.Printf("Ignoring etcd proxy at %s\n", c.peerIP.String())
+			case *peerBootingEvent:
+				fmt.Printf("Peer at '%s' not available yet: %s\n", c.url, e.reason.Error())
+				cs.etcd.AddBootingPeer(c.name, c.iface, c.localIP, c.peerIP, c.peerPort, c.priority)
+				self := clusterMember{name: cs.etcd.Name, peerIP: c.localIP, peerPort: cs.etcd.PeerPort, priority: cs.cfg.Priority}
+				if cs.election.ShouldWait(self, c.member()) {
+					// the peer should found; wait for it to come up
+					lastPollWithHigherPeer = polls
+				}
+			case *serverFoundEvent:
+				fmt.Printf("Peer etcd server found on %s (%s); exiting\n", c.url, c.peerIP)
+				cs.etcd.AddServerPeer(c.name, c.iface, c.localIP, c.peerIP, c.peerPort, c.clientPort)
+				cs.etcd.DiscoveryURL = ""
+				finished = true
+			}
+		case <-cs.proposalSeen:
+			// another node is already founding a cluster that includes us
+			fmt.Printf("Founding proposal received\n")
+			finished = true
 		case url := <-cs.discoveryURL:
 			// url is already validated
-			cs.etcd.DiscoveryURL = url
 			finished = true
+			if err := cs.joinDiscoveryCluster(url); err != nil {
+				fmt.Printf("Fatal error from discovery URL: %s\n", err.Error())
+				errOut = err
+			}
 		}
 	}
 
@@ -284,9 +600,10 @@ func (cs *ClientState) stateTask() (errOut error) {
 
 func (cs *ClientState) validateDiscoveryURL(url string) bool {
 	if url != "" {
-		if _, err := http.Get(url); err != nil {
+		if resp, err := cs.prober.discovery().Get(url); err != nil {
 			fmt.Printf("Poll discovery URL '%s' returns error: %s\n", url, err.Error())
 		} else {
+			resp.Body.Close()
 			cs.discoveryURL <- url
 			return true
 		}
@@ -318,22 +635,91 @@ func Client() {
 	if err != nil || len(args) > 1 {
 		fmt.Printf("Error parsing options; un-parsed options remain: %s\n", strings.Join(args[1:], ", "))
 	} else {
-		cs := newClientState(cfg, etcd)
+		discoverers, err := newDiscoverers(cfg)
+		if err != nil {
+			fmt.Printf("Error parsing options: %s\n", err.Error())
+			os.Exit(1)
+		}
+		cs := newClientState(cfg, etcd, discoverers)
+		if err := checkPKIOptions(cfg); err != nil {
+			fmt.Printf("Error parsing options: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if cfg.PKI {
+			cs.tlsPaths()
+		}
+		if cfg.Reap && (!cfg.Daemon || etcd.ConfFormat == "toml") {
+			fmt.Printf("Error parsing options: --reap requires --daemon and the etcd 2+ members API (--etcd_conf_format env or yaml)\n")
+			os.Exit(1)
+		}
+		if cs.election, err = newElectionStrategy(cs); err != nil {
+			fmt.Printf("Error parsing options: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if cfg.MDNSPublisher == "native" {
+			if err := cs.startResponder(); err != nil {
+				fmt.Printf("Error starting mDNS responder: %s\n", err.Error())
+				os.Exit(1)
+			}
+		} else {
+			cs.WriteAvahiServiceFile()
+		}
 
-		cs.WriteAvahiServiceFile()
+		if cfg.EchoPort != 0 {
+			if err := cs.startEcho(); err != nil {
+				// peers beyond a router will not be able to check us, but local ones are fine
+				fmt.Printf("Error starting echo endpoint: %s\n", err.Error())
+			}
+		}
 
-		// if a discovery URL is present, test it and publish if successful
-		usingDiscoveryURL := cs.checkDiscoveryURL()
+		go cs.pollLoop()
 
-		// otherwise start mDNS polling
-		if !usingDiscoveryURL {
-			go cs.pollLoop()
+		if cfg.Handshake {
+			if err = cs.startHandshake(); err != nil {
+				fmt.Printf("Error starting founding handshake: %s\n", err.Error())
+				os.Exit(1)
+			}
 		}
 
-		err := cs.stateTask()
+		err = cs.stateTask()
+		if err == nil && len(etcd.ServerPeers) == 0 && etcd.ClusterState == "" {
+			err = cs.found()
+		}
+		if err == nil && cfg.PKI {
+			if err = cs.setupPKI(); err != nil {
+				fmt.Printf("Fatal error setting up TLS: %s\n", err.Error())
+			}
+		}
+		cs.stopHandshake()
+		if !cfg.Daemon {
+			cs.stopResponder()
+		}
+		// etcd 2+ must be added through the members API before it can join a running cluster
+		if err == nil && len(etcd.ServerPeers) > 0 && etcd.ConfFormat != "toml" {
+			if err = cs.joinCluster(); err != nil {
+				fmt.Printf("Fatal error joining cluster: %s\n", err.Error())
+			}
+		}
 		if err == nil {
 			etcd.WriteFile()
 			fleet.WriteFile(etcd)
+			// etcd starts from the conf we just wrote; tell booting peers not to bother probing
+			cs.role = roleServer
+			if cfg.MDNSPublisher != "native" {
+				cs.WriteAvahiServiceFile()
+			} else if cs.responder != nil {
+				cs.responder.SetText(cs.txtRecords())
+			}
+			// with --daemon, a CA we hold stays up for as long as we run
+			if cfg.Daemon {
+				cs.watch(func() {
+					etcd.WriteFile()
+					fleet.WriteFile(etcd)
+				})
+			}
+			cs.lingerPKI()
+			cs.stopEcho()
 		} else {
 			os.Exit(1)
 		}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+// newTestState is a ClientState for tests, with the maps that loading the etcd config would make.
+// Its channels are buffered, so a test can poll a discoverer and read back what it found from the
+// same goroutine.
+func newTestState(cfg *common.Config, etcd *common.EtcdConfig) *ClientState {
+	if etcd == nil {
+		etcd = &common.EtcdConfig{}
+	}
+	if etcd.InitialCluster == nil {
+		etcd.InitialCluster = make(map[string]string)
+	}
+	if etcd.ServerPeers == nil {
+		etcd.ServerPeers = make(map[string]common.EtcdPeer)
+	}
+	if etcd.BootingPeers == nil {
+		etcd.BootingPeers = make(map[string]common.EtcdPeer)
+	}
+	cs := newClientState(cfg, etcd, nil)
+	cs.peerCandidates = make(chan *AvahiBrowseResult, 16)
+	return cs
+}
+
+func TestCheckCluster(t *testing.T) {
+	ours := []string{"cluster=prod", "join_token=" + joinTokenHash("t0ken")}
+	tests := []struct {
+		name    string
+		cluster string
+		token   string
+		source  string
+		txt     []string
+		wantErr bool
+	}{
+		{name: "same cluster", cluster: "prod", token: "t0ken", source: "mdns", txt: ours},
+		{name: "other cluster", cluster: "prod", token: "t0ken", source: "mdns", txt: []string{"cluster=dev"}, wantErr: true},
+		{name: "other token", cluster: "prod", token: "t0ken", source: "udp", txt: []string{"cluster=prod", "join_token=0000"}, wantErr: true},
+		{name: "no TXT from mdns", cluster: "prod", token: "t0ken", source: "mdns", txt: nil, wantErr: true},
+		{name: "no TXT from avahi", cluster: "prod", source: "avahi", txt: nil, wantErr: true},
+		{name: "no TXT, token only", token: "t0ken", source: "mdns", txt: nil, wantErr: true},
+		{name: "no TXT, unnamed cluster", source: "mdns", txt: nil},
+		{name: "named peer, unnamed cluster", source: "mdns", txt: ours, wantErr: true},
+		{name: "static seed", cluster: "prod", token: "t0ken", source: "static", txt: nil},
+		{name: "SRV record", cluster: "prod", token: "t0ken", source: "srv", txt: nil},
+	}
+	for _, tt := range tests {
+		cs := newTestState(&common.Config{ClusterName: tt.cluster, JoinToken: tt.token}, nil)
+		err := cs.checkCluster(&AvahiBrowseResult{Name: "peer", Source: tt.source, TXT: tt.txt})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkCluster returned %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// interfaceIPv4 is an address of ours that LocalNetForIp knows, as a routed peer would reach us on
+func interfaceIPv4(t *testing.T) net.IP {
+	for _, ip := range common.LocalAddrs() {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	t.Skip("no non-loopback IPv4 address to test with")
+	return nil
+}
@@ -0,0 +1,282 @@
+package client
+
+import (
+	"fmt"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// With --daemon we keep browsing once our conf is written, and keep a table of the peers we can
+// see. A peer appears when first seen, changes when its set of live addresses or its role does,
+// and disappears once none of its addresses has been seen for --peer_expiry. Each event is
+// logged, passed to --peer_event_command, and with --daemon_rewrite the conf is rewritten when
+// the set of server peers changes. --reap (see reaper.go) removes members that stay gone.
+
+const (
+	peerAppeared    = "appeared"
+	peerChanged     = "changed"
+	peerDisappeared = "disappeared"
+)
+
+type peerEvent struct {
+	kind     string
+	name     string
+	role     string
+	addrs    []string // live addresses after the event
+	oldAddrs []string // live addresses before it
+}
+
+type peerAddr struct {
+	iface    *net.Interface
+	localIP  net.IP
+	peerIP   net.IP
+	peerPort int
+	lastSeen time.Time
+}
+
+type peerRecord struct {
+	name  string
+	role  string
+	addrs map[string]*peerAddr
+}
+
+func (r *peerRecord) addrList() []string {
+	list := make([]string, 0, len(r.addrs))
+	for k, _ := range r.addrs {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// etcdPeer describes the peer by its lowest live address, so that a rewrite is stable
+func (r *peerRecord) etcdPeer() common.EtcdPeer {
+	a := r.addrs[r.addrList()[0]]
+	return common.EtcdPeer{Name: r.name, Interface: a.iface, LocalIP: a.localIP, PeerIP: a.peerIP, PeerPort: a.peerPort}
+}
+
+// peerTable is only used from the watch loop, so needs no locking
+type peerTable struct {
+	peers  map[string]*peerRecord
+	expiry time.Duration
+}
+
+func newPeerTable(expiry time.Duration) *peerTable {
+	return &peerTable{peers: make(map[string]*peerRecord), expiry: expiry}
+}
+
+func (t *peerTable) known(name string, peerIP net.IP) bool {
+	r, ok := t.peers[name]
+	return ok && r.addrs[peerIP.String()] != nil
+}
+
+// seen records a sighting of a peer on one address, returning the event it causes if any
+func (t *peerTable) seen(c *peerCandidate, now time.Time) *peerEvent {
+	addr := &peerAddr{iface: c.iface, localIP: c.localIP, peerIP: c.peerIP, peerPort: c.peerPort, lastSeen: now}
+	r, ok := t.peers[c.name]
+	if !ok {
+		r = &peerRecord{name: c.name, role: c.role, addrs: map[string]*peerAddr{c.peerIP.String(): addr}}
+		t.peers[c.name] = r
+		return &peerEvent{kind: peerAppeared, name: r.name, role: r.role, addrs: r.addrList(), oldAddrs: []string{}}
+	}
+	oldAddrs := r.addrList()
+	old, known := r.addrs[c.peerIP.String()]
+	if known && addr.localIP == nil {
+		// a routed address keeps the local side its return path was checked with
+		addr.iface, addr.localIP = old.iface, old.localIP
+	}
+	r.addrs[c.peerIP.String()] = addr
+	if known && r.role == c.role {
+		return nil
+	}
+	r.role = c.role
+	return &peerEvent{kind: peerChanged, name: r.name, role: r.role, addrs: r.addrList(), oldAddrs: oldAddrs}
+}
+
+// expire forgets addresses not seen for a while, and peers with none left
+func (t *peerTable) expire(now time.Time) []*peerEvent {
+	events := make([]*peerEvent, 0)
+	names := make([]string, 0, len(t.peers))
+	for name, _ := range t.peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := t.peers[name]
+		oldAddrs := r.addrList()
+		for k, a := range r.addrs {
+			if now.Sub(a.lastSeen) > t.expiry {
+				delete(r.addrs, k)
+			}
+		}
+		if len(r.addrs) == 0 {
+			delete(t.peers, name)
+			events = append(events, &peerEvent{kind: peerDisappeared, name: name, role: r.role, addrs: []string{}, oldAddrs: oldAddrs})
+		} else if len(r.addrs) != len(oldAddrs) {
+			events = append(events, &peerEvent{kind: peerChanged, name: name, role: r.role, addrs: r.addrList(), oldAddrs: oldAddrs})
+		}
+	}
+	return events
+}
+
+func (t *peerTable) names() map[string]bool {
+	names := make(map[string]bool)
+	for name, _ := range t.peers {
+		names[name] = true
+	}
+	return names
+}
+
+// servers are the peers that count as cluster members for a rewrite; booting peers and proxies
+// do not, and backends without TXT cannot tell us, so those count
+func (t *peerTable) servers() map[string]common.EtcdPeer {
+	servers := make(map[string]common.EtcdPeer)
+	for _, r := range t.peers {
+		if r.role == roleBooting || r.role == roleProxy {
+			continue
+		}
+		p := r.etcdPeer()
+		servers[p.PeerIP.String()] = p
+	}
+	return servers
+}
+
+func serverSet(servers map[string]common.EtcdPeer) string {
+	list := make([]string, 0, len(servers))
+	for k, p := range servers {
+		list = append(list, p.Name+"@"+k)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// isWatching is true once bootstrap is over and the watch loop owns the peer channels
+func (cs *ClientState) isWatching() bool {
+	select {
+	case <-cs.watching:
+		return true
+	default:
+		return false
+	}
+}
+
+// watch runs the peer table until we are killed. rewrite writes out the conf again.
+func (cs *ClientState) watch(rewrite func()) {
+	table := newPeerTable(cs.cfg.PeerExpiry)
+	pool := newProbePool(cs.prober, cs.cfg.ProbeWorkers)
+	defer pool.stop()
+	probing := make(map[string]bool) // name@address of routed addresses whose return path is being checked
+	lastServers := serverSet(cs.etcd.ServerPeers)
+	// the table starts empty; give every peer a chance to be seen before trusting it
+	warm := time.Now().Add(cs.cfg.PeerExpiry)
+	close(cs.watching)
+	fmt.Printf("Watching for peers\n")
+	var reaped chan string
+	var rp *reaper
+	if cs.cfg.Reap {
+		rp = newReaper(cs)
+		reaped = rp.reaped
+		go rp.run()
+	}
+
+	for {
+		var events []*peerEvent
+		select {
+		case ent := <-cs.peerCandidates:
+			if ev := cs.watchEnt(table, pool, probing, ent); ev != nil {
+				events = []*peerEvent{ev}
+			}
+		case ev := <-pool.results:
+			c := ev.candidate()
+			delete(probing, c.name+"@"+c.peerIP.String())
+			if e, ok := ev.(*peerRejectedEvent); ok {
+				fmt.Println("etcd server", c.ent, "invalid", e.reason)
+			} else if seen := table.seen(c, time.Now()); seen != nil {
+				events = []*peerEvent{seen}
+			}
+		case <-cs.pollEvent:
+			events = table.expire(time.Now())
+			if rp != nil {
+				rp.observe(table.names())
+			}
+		case name := <-reaped:
+			// the reaper has removed it from etcd; forget our own record of it too
+			for k, p := range cs.etcd.ServerPeers {
+				if p.Name == name {
+					delete(cs.etcd.ServerPeers, k)
+				}
+			}
+			delete(cs.etcd.InitialCluster, name)
+			if cs.cfg.DaemonRewrite {
+				rewrite()
+			}
+		case <-cs.discoveryURL:
+			// etcd looks after membership through the discovery URL itself
+		}
+		for _, ev := range events {
+			cs.emitPeerEvent(ev)
+		}
+		if cs.cfg.DaemonRewrite && time.Now().After(warm) {
+			if servers := table.servers(); serverSet(servers) != lastServers {
+				fmt.Printf("Server peers changed from [%s] to [%s]; rewriting conf\n", lastServers, serverSet(servers))
+				lastServers = serverSet(servers)
+				cs.etcd.ServerPeers = servers
+				// membership is what we see now, not what we founded with
+				cs.etcd.InitialCluster = make(map[string]string)
+				cs.etcd.Peers = make([]string, 0)
+				rewrite()
+			}
+		}
+	}
+}
+
+// watchEnt records a sighting. A new routed address first has its return path checked on the
+// probe pool, so that a slow peer never holds up the loop; the sighting counts once that is done.
+func (cs *ClientState) watchEnt(table *peerTable, pool *probePool, probing map[string]bool, ent *AvahiBrowseResult) *peerEvent {
+	iface, localIP, peerIP, err, fatalErr := cs.checkEnt(ent)
+	if fatalErr != nil {
+		fmt.Printf("Fatal error from peer server entry: %s\n", err.Error())
+		os.Exit(1)
+	} else if err != nil {
+		return nil
+	}
+	c := cs.newPeerCandidate(ent, iface, localIP, peerIP)
+	if c.localIP != nil || table.known(c.name, c.peerIP) {
+		return table.seen(c, time.Now())
+	}
+	key := c.name + "@" + c.peerIP.String()
+	if probing[key] {
+		return nil
+	}
+	c.pathOnly = true
+	if pool.submit(c) {
+		probing[key] = true
+	} else {
+		fmt.Printf("Probe queue full; dropping %s until it is next seen\n", peerIP.String())
+	}
+	return nil
+}
+
+func (cs *ClientState) emitPeerEvent(ev *peerEvent) {
+	addrs := strings.Join(ev.addrs, ",")
+	oldAddrs := strings.Join(ev.oldAddrs, ",")
+	fmt.Printf("Peer '%s' %s: role '%s' addresses [%s] (was [%s])\n", ev.name, ev.kind, ev.role, addrs, oldAddrs)
+	if cs.cfg.EventCommand == "" {
+		return
+	}
+	cmd := exec.Command("/bin/sh", "-c", cs.cfg.EventCommand)
+	cmd.Env = append(os.Environ(),
+		"PEER_EVENT="+ev.kind,
+		"PEER_NAME="+ev.name,
+		"PEER_ROLE="+ev.role,
+		"PEER_ADDRS="+addrs,
+		"PEER_OLD_ADDRS="+oldAddrs)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Printf("Peer event command failed: %s: %s\n", err.Error(), strings.TrimSpace(string(out)))
+	}
+}
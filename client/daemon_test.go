@@ -0,0 +1,150 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+func testCandidate(name string, role string, peerIP string, localIP string) *peerCandidate {
+	c := &peerCandidate{name: name, role: role, peerIP: net.ParseIP(peerIP), peerPort: 2380}
+	if localIP != "" {
+		c.iface = &net.Interface{Name: "eth0"}
+		c.localIP = net.ParseIP(localIP)
+	}
+	return c
+}
+
+func TestPeerTable(t *testing.T) {
+	table := newPeerTable(30 * time.Second)
+	start := time.Now()
+	describe := func(ev *peerEvent) string {
+		if ev == nil {
+			return "none"
+		}
+		return fmt.Sprintf("%s %s %s [%s] was [%s]", ev.kind, ev.name, ev.role, strings.Join(ev.addrs, ","), strings.Join(ev.oldAddrs, ","))
+	}
+
+	steps := []struct {
+		name string
+		c    *peerCandidate
+		at   time.Duration
+		want string
+	}{
+		{name: "first sighting", c: testCandidate("a", roleBooting, "10.0.0.1", "10.0.0.9"), want: "appeared a booting [10.0.0.1] was []"},
+		{name: "seen again", c: testCandidate("a", roleBooting, "10.0.0.1", "10.0.0.9"), at: 5 * time.Second, want: "none"},
+		{name: "second address", c: testCandidate("a", roleBooting, "10.1.0.1", "10.1.0.9"), at: 10 * time.Second, want: "changed a booting [10.0.0.1,10.1.0.1] was [10.0.0.1]"},
+		{name: "now serving", c: testCandidate("a", roleServer, "10.0.0.1", "10.0.0.9"), at: 20 * time.Second, want: "changed a server [10.0.0.1,10.1.0.1] was [10.0.0.1,10.1.0.1]"},
+		// a routed address seen again without its local side keeps the one that was checked
+		{name: "routed", c: testCandidate("b", roleServer, "192.168.5.5", "10.0.0.9"), at: 20 * time.Second, want: "appeared b server [192.168.5.5] was []"},
+		{name: "routed again", c: testCandidate("b", roleServer, "192.168.5.5", ""), at: 25 * time.Second, want: "none"},
+		{name: "proxy", c: testCandidate("p", roleProxy, "10.0.0.3", "10.0.0.9"), at: 25 * time.Second, want: "appeared p proxy [10.0.0.3] was []"},
+	}
+	for _, step := range steps {
+		if got := describe(table.seen(step.c, start.Add(step.at))); got != step.want {
+			t.Errorf("%s: event %s, want %s", step.name, got, step.want)
+		}
+	}
+	if b := table.peers["b"].addrs["192.168.5.5"]; !b.localIP.Equal(net.ParseIP("10.0.0.9")) || b.iface == nil {
+		t.Errorf("routed address lost its local side: %v on %v", b.localIP, b.iface)
+	}
+	if !table.known("b", net.ParseIP("192.168.5.5")) || table.known("b", net.ParseIP("10.0.0.1")) {
+		t.Errorf("known addresses of b wrong")
+	}
+	if got := serverSet(table.servers()); got != "a@10.0.0.1,b@192.168.5.5" {
+		t.Errorf("servers %s, want a and b by their lowest address, and no proxy", got)
+	}
+
+	// 10.1.0.1 was last seen at 10s, the others at 20s and 25s
+	expired := make([]string, 0)
+	for _, ev := range table.expire(start.Add(45 * time.Second)) {
+		expired = append(expired, describe(ev))
+	}
+	if got := strings.Join(expired, "; "); got != "changed a server [10.0.0.1] was [10.0.0.1,10.1.0.1]" {
+		t.Errorf("expiry at 45s: %s", got)
+	}
+	expired = expired[:0]
+	for _, ev := range table.expire(start.Add(time.Minute)) {
+		expired = append(expired, describe(ev))
+	}
+	want := "disappeared a server [] was [10.0.0.1]; disappeared b server [] was [192.168.5.5]; disappeared p proxy [] was [10.0.0.3]"
+	if got := strings.Join(expired, "; "); got != want {
+		t.Errorf("expiry at 60s: %s, want %s", got, want)
+	}
+	if len(table.peers) != 0 || len(table.servers()) != 0 {
+		t.Errorf("peers left after every address expired: %v", table.peers)
+	}
+}
+
+// hungEcho accepts connections and never answers them
+func hungEcho(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]net.Conn, 0)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// a routed peer is checked on the probe pool, so the watch loop goes on while its echo hangs
+func TestWatchEntRouted(t *testing.T) {
+	cfg := &common.Config{UUID: "0a1b2c3d", EchoPort: 1, ProbeTimeout: time.Second}
+	cs := newTestState(cfg, nil)
+	table := newPeerTable(30 * time.Second)
+	pool := newProbePool(cs.prober, 2)
+	defer pool.stop()
+	probing := make(map[string]bool)
+
+	tests := []struct {
+		name     string
+		echoPort int
+		wantType string
+	}{
+		{name: "hung", echoPort: hungEcho(t), wantType: "*client.peerRejectedEvent"},
+		{name: "natted", echoPort: natEcho(t, "203.0.113.5"), wantType: "*client.peerRejectedEvent"},
+	}
+	for i, tt := range tests {
+		// loopback is on no subnet LocalNetForIp knows, so it is treated as routed
+		ent := &AvahiBrowseResult{Name: tt.name, IPv4: net.IPv4(127, 0, 0, byte(i+1)), Port: 2380, Source: "udp",
+			TXT: []string{"role=server", fmt.Sprintf("echo_port=%d", tt.echoPort)}}
+		start := time.Now()
+		if ev := cs.watchEnt(table, pool, probing, ent); ev != nil {
+			t.Errorf("%s: event before the return path was checked: %+v", tt.name, ev)
+		}
+		if time.Since(start) > 100*time.Millisecond {
+			t.Errorf("%s: watchEnt took %s; it must not wait for the echo", tt.name, time.Since(start).String())
+		}
+		// seen again while the check is running, it is not queued twice
+		cs.watchEnt(table, pool, probing, ent)
+		if len(probing) != 1 {
+			t.Errorf("%s: %d checks running, want 1", tt.name, len(probing))
+		}
+		select {
+		case ev := <-pool.results:
+			if got := fmt.Sprintf("%T", ev); got != tt.wantType || ev.candidate().name != tt.name {
+				t.Errorf("%s: %s for '%s', want %s", tt.name, got, ev.candidate().name, tt.wantType)
+			}
+			c := ev.candidate()
+			delete(probing, c.name+"@"+c.peerIP.String())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: return path check did not finish", tt.name)
+		}
+		if table.known(tt.name, ent.IPv4) {
+			t.Errorf("%s: rejected peer in the table", tt.name)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"fmt"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"strings"
+)
+
+// Discoverer is one mechanism for finding peers. Poll is called once per poll interval; it sends
+// any peer candidates found to cs.peerCandidates, or a validated URL to cs.discoveryURL. Returning
+// true means discovery is settled and the remaining backends need not be polled.
+type Discoverer interface {
+	Name() string
+	Poll(cs *ClientState) bool
+}
+
+var discovererFactories = map[string]func() Discoverer{
+	"url":    func() Discoverer { return &urlDiscoverer{} },
+	"mdns":   func() Discoverer { return &mdnsDiscoverer{} },
+	"avahi":  func() Discoverer { return &avahiDiscoverer{} },
+	"udp":    func() Discoverer { return &udpDiscoverer{} },
+	"srv":    func() Discoverer { return &srvDiscoverer{} },
+	"static": func() Discoverer { return &staticDiscoverer{} },
+}
+
+func newDiscoverers(cfg *common.Config) ([]Discoverer, error) {
+	names := strings.Split(cfg.Discovery, ",")
+	// --mdns_browser predates --discovery, and picked the browser now chosen with it
+	switch cfg.MDNSBrowser {
+	case "", "native":
+	case "avahi":
+		for i, name := range names {
+			if strings.TrimSpace(name) == "mdns" {
+				names[i] = "avahi"
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown --mdns_browser '%s'; use --discovery instead", cfg.MDNSBrowser)
+	}
+	if cfg.MDNSBrowser != "" {
+		fmt.Printf("--mdns_browser is deprecated; browsing with '%s' backends\n", strings.Join(names, ","))
+	}
+	// seeds are pointless without the static backend, so giving any implies it
+	if len(cfg.Seeds) > 0 || cfg.PeersFile != "" {
+		hasStatic := false
+		for _, name := range names {
+			hasStatic = hasStatic || strings.TrimSpace(name) == "static"
+		}
+		if !hasStatic {
+			names = append(names, "static")
+		}
+	}
+
+	discoverers := make([]Discoverer, 0)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		factory, ok := discovererFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown discovery backend '%s'", name)
+		}
+		if cfg.Handshake && (name == "static" || name == "srv") {
+			// handshake messages go to members by etcd name, and these only give a host name
+			return nil, fmt.Errorf("--handshake needs the etcd names that mdns, avahi and udp discovery announce; the '%s' backend has none", name)
+		}
+		discoverers = append(discoverers, factory())
+	}
+	if len(discoverers) == 0 {
+		return nil, fmt.Errorf("No discovery backends selected")
+	}
+	return discoverers, nil
+}
+
+// urlDiscoverer checks the etcd discovery URL from flags, environment or file
+type urlDiscoverer struct {
+	checked bool
+	found   bool
+}
+
+func (d *urlDiscoverer) Name() string {
+	return "url"
+}
+
+func (d *urlDiscoverer) Poll(cs *ClientState) bool {
+	// the URL sources do not change while we run, so only check them once
+	if !d.checked {
+		d.checked = true
+		d.found = cs.checkDiscoveryURL()
+	}
+	return d.found
+}
+
+// mdnsDiscoverer browses with the built-in mDNS browser
+type mdnsDiscoverer struct{}
+
+func (d *mdnsDiscoverer) Name() string {
+	return "mdns"
+}
+
+func (d *mdnsDiscoverer) Poll(cs *ClientState) bool {
+	runNativeBrowse(cs.cfg.MDNSService, cs.cfg.MDNSDomain, cs.cfg.MDNSTimeout, cs.peerCandidates)
+	return false
+}
+
+// avahiDiscoverer browses by running avahi-browse
+type avahiDiscoverer struct{}
+
+func (d *avahiDiscoverer) Name() string {
+	return "avahi"
+}
+
+func (d *avahiDiscoverer) Poll(cs *ClientState) bool {
+	runAvahiBrowse(cs.cfg.MDNSService, cs.peerCandidates)
+	return false
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+func TestNewDiscoverers(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     common.Config
+		want    string // backend names, or "" for an error
+		wantErr bool
+	}{
+		{name: "plain", cfg: common.Config{Discovery: "url,mdns"}, want: "url,mdns"},
+		{name: "seeds imply static", cfg: common.Config{Discovery: "mdns", Seeds: []string{"10.0.0.1"}}, want: "mdns,static"},
+		{name: "peers file implies static", cfg: common.Config{Discovery: "udp", PeersFile: "/etc/peers"}, want: "udp,static"},
+		{name: "deprecated browser", cfg: common.Config{Discovery: "url, mdns", MDNSBrowser: "avahi"}, want: "url,avahi"},
+		{name: "unknown browser", cfg: common.Config{Discovery: "mdns", MDNSBrowser: "bonjour"}, wantErr: true},
+		{name: "unknown backend", cfg: common.Config{Discovery: "mdns,carrier-pigeon"}, wantErr: true},
+		{name: "none", cfg: common.Config{Discovery: " , "}, wantErr: true},
+		{name: "handshake", cfg: common.Config{Discovery: "mdns,avahi,udp", Handshake: true}, want: "mdns,avahi,udp"},
+		{name: "handshake with seeds", cfg: common.Config{Discovery: "mdns", Seeds: []string{"10.0.0.1"}, Handshake: true}, wantErr: true},
+		{name: "handshake with srv", cfg: common.Config{Discovery: "srv", Handshake: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		discoverers, err := newDiscoverers(&tt.cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: newDiscoverers returned %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		names := make([]string, 0, len(discoverers))
+		for _, d := range discoverers {
+			names = append(names, d.Name())
+		}
+		if got := strings.Join(names, ","); got != tt.want {
+			t.Errorf("%s: backends %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The echo endpoint answers every TCP connection with the address it came from, then hangs up.
+// It lets a peer beyond a router check the return path: if we see the address it dialled from,
+// we can reach it back on that address. Through a NAT we see the NAT's address instead.
+
+func (cs *ClientState) startEcho() error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", cs.cfg.EchoPort))
+	if err != nil {
+		return err
+	}
+	cs.echoListener = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			conn.SetWriteDeadline(time.Now().Add(cs.cfg.ProbeTimeout))
+			fmt.Fprintf(conn, "%s\n", host)
+			conn.Close()
+		}
+	}()
+	return nil
+}
+
+// stopEcho is left until after the PKI linger, so routed joiners can still check us meanwhile
+func (cs *ClientState) stopEcho() {
+	if cs.echoListener != nil {
+		cs.echoListener.Close()
+		cs.echoListener = nil
+	}
+}
+
+// echo connects to a peer's echo endpoint, from fromIP if it is set, and returns the local
+// address the connection left from, and the address the peer saw it arrive from
+func (p *prober) echo(peerIP net.IP, port int, fromIP net.IP) (net.IP, net.IP, error) {
+	addr := net.JoinHostPort(peerIP.String(), strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: p.cfg.ProbeTimeout}
+	if fromIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: fromIP}
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(p.cfg.ProbeTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading echo from %s: %s", addr, err.Error())
+	}
+	seen := net.ParseIP(strings.TrimSpace(line))
+	if seen == nil {
+		return nil, nil, fmt.Errorf("echo from %s is not an address: '%s'", addr, strings.TrimSpace(line))
+	}
+	return conn.LocalAddr().(*net.TCPAddr).IP, seen, nil
+}
+
+// advertisedIP is the address peers will be given for us, once it is settled: by
+// --etcd_peer_addr or --etcd_client_addr, by --addr_from, or when our conf is written. It reads
+// the etcd config, so it is only called from stateTask; probe workers get a copy in the candidate.
+func (cs *ClientState) advertisedIP() net.IP {
+	for _, a := range []string{cs.etcd.PeerAddr, cs.etcd.ClientAddr} {
+		if ip, _ := common.SplitZone(a); ip != nil && !ip.IsUnspecified() {
+			return ip
+		}
+	}
+	return nil
+}
+
+// checkReturnPath fills in the local side of a candidate that is not on a directly connected
+// subnet, once its echo shows that it sees us on the address we give it. Until that address is
+// settled, it is the one the connection leaves from, which is what SetupAddresses will choose.
+func (p *prober) checkReturnPath(c *peerCandidate) error {
+	localIP, seen, err := p.echo(c.peerIP, c.echoPort, c.advertised)
+	if err != nil {
+		return fmt.Errorf("peer %s is not on a local subnet and its return path could not be checked: %s", c.peerIP.String(), err.Error())
+	}
+	if c.advertised != nil {
+		localIP = c.advertised
+	}
+	if !seen.Equal(localIP) {
+		return fmt.Errorf("peer %s sees us as %s, not %s; NAT in the path", c.peerIP.String(), seen.String(), localIP.String())
+	}
+	iface, _, _, err := common.LocalNetForIp(localIP)
+	if err != nil {
+		return err
+	}
+	if err := p.etcd.CheckAddrPolicy(iface, localIP); err != nil {
+		return fmt.Errorf("peer %s is reached from %s: %s", c.peerIP.String(), localIP.String(), err.Error())
+	}
+	fmt.Printf("Peer %s is routed; return path to %s on %s verified\n", c.peerIP.String(), localIP.String(), iface.Name)
+	c.iface = iface
+	c.localIP = localIP
+	return nil
+}
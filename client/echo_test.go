@@ -0,0 +1,70 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+// natEcho answers every connection with the same address, as an echo behind a NAT would
+func natEcho(t *testing.T, addr string) int {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "%s\n", addr)
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestCheckReturnPath(t *testing.T) {
+	ours := interfaceIPv4(t)
+	cfg := &common.Config{ProbeTimeout: 2 * time.Second}
+	echo := newTestState(cfg, nil)
+	if err := echo.startEcho(); err != nil {
+		t.Fatal(err)
+	}
+	defer echo.stopEcho()
+	echoPort := echo.echoListener.Addr().(*net.TCPAddr).Port
+
+	tests := []struct {
+		name       string
+		peerAddr   string
+		clientAddr string
+		echoPort   int
+		wantErr    bool
+	}{
+		{name: "not yet settled", echoPort: echoPort},
+		{name: "advertised peer address", peerAddr: ours.String(), echoPort: echoPort},
+		{name: "advertised client address", clientAddr: ours.String(), echoPort: echoPort},
+		// the connection could leave from ours, but peers would be given an address we do not hold
+		{name: "advertised elsewhere", peerAddr: "198.51.100.7", echoPort: echoPort, wantErr: true},
+		{name: "NAT", peerAddr: ours.String(), echoPort: natEcho(t, "203.0.113.5"), wantErr: true},
+	}
+	for _, tt := range tests {
+		cs := newTestState(cfg, &common.EtcdConfig{PeerAddr: tt.peerAddr, ClientAddr: tt.clientAddr})
+		ent := &AvahiBrowseResult{Name: "peer", Port: 2380, TXT: []string{fmt.Sprintf("echo_port=%d", tt.echoPort)}}
+		c := cs.newPeerCandidate(ent, nil, nil, ours)
+		// the address may be settled while the candidate waits in the queue; the probe goes by
+		// what it was when queued, and never reads the etcd config stateTask owns
+		cs.etcd.PeerAddr = "192.0.2.1"
+		err := cs.prober.checkReturnPath(c)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkReturnPath returned %v, want error %v", tt.name, err, tt.wantErr)
+		} else if err == nil && !c.localIP.Equal(ours) {
+			t.Errorf("%s: local address %v, want %s", tt.name, c.localIP, ours.String())
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ElectionStrategy decides which node founds a new cluster. While polling, ShouldWait says
+// whether a booting peer outranks us, in which case we keep waiting for it to become a server
+// rather than founding ourselves. Founder picks the founder from an agreed member set. Every node
+// must be configured with the same strategy.
+type ElectionStrategy interface {
+	Name() string
+	ShouldWait(self clusterMember, peer clusterMember) bool
+	Founder(members []clusterMember) clusterMember
+}
+
+var electionFactories = map[string]func(cs *ClientState) ElectionStrategy{
+	"ip":       func(cs *ClientState) ElectionStrategy { return &lowestIPElection{} },
+	"uuid":     func(cs *ClientState) ElectionStrategy { return &lowestUUIDElection{} },
+	"priority": func(cs *ClientState) ElectionStrategy { return &priorityElection{} },
+	"seed":     func(cs *ClientState) ElectionStrategy { return newSeedElection(cs) },
+}
+
+func newElectionStrategy(cs *ClientState) (ElectionStrategy, error) {
+	factory, ok := electionFactories[cs.cfg.Election]
+	if !ok {
+		return nil, fmt.Errorf("Unknown election strategy '%s'", cs.cfg.Election)
+	}
+	return factory(cs), nil
+}
+
+// founderBy returns the member that sorts first under less
+func founderBy(members []clusterMember, less func(a, b clusterMember) bool) clusterMember {
+	founder := members[0]
+	for _, m := range members[1:] {
+		if less(m, founder) {
+			founder = m
+		}
+	}
+	return founder
+}
+
+// compareIP orders addresses numerically, so that 10.0.0.9 comes before 10.0.0.10
+func compareIP(a net.IP, b net.IP) int {
+	return bytes.Compare(a.To16(), b.To16())
+}
+
+func lowerIP(a clusterMember, b clusterMember) bool {
+	if c := compareIP(a.peerIP, b.peerIP); c != 0 {
+		return c < 0
+	}
+	return a.name < b.name
+}
+
+// lowestIPElection: the node with the numerically lowest peer address founds
+type lowestIPElection struct{}
+
+func (e *lowestIPElection) Name() string {
+	return "ip"
+}
+
+func (e *lowestIPElection) ShouldWait(self clusterMember, peer clusterMember) bool {
+	return lowerIP(peer, self)
+}
+
+func (e *lowestIPElection) Founder(members []clusterMember) clusterMember {
+	return founderBy(members, lowerIP)
+}
+
+// lowestUUIDElection: the node with the lowest name founds. Names are UUIDs unless configured
+// otherwise, which keeps the choice stable when addresses change.
+type lowestUUIDElection struct{}
+
+func (e *lowestUUIDElection) Name() string {
+	return "uuid"
+}
+
+func (e *lowestUUIDElection) ShouldWait(self clusterMember, peer clusterMember) bool {
+	return peer.name < self.name
+}
+
+func (e *lowestUUIDElection) Founder(members []clusterMember) clusterMember {
+	return founderBy(members, func(a, b clusterMember) bool { return a.name < b.name })
+}
+
+// priorityElection: the node with the highest --priority founds, published to peers in the
+// "priority" TXT key. Ties fall back to the lowest address.
+type priorityElection struct{}
+
+func (e *priorityElection) Name() string {
+	return "priority"
+}
+
+func (e *priorityElection) less(a clusterMember, b clusterMember) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return lowerIP(a, b)
+}
+
+func (e *priorityElection) ShouldWait(self clusterMember, peer clusterMember) bool {
+	return e.less(peer, self)
+}
+
+func (e *priorityElection) Founder(members []clusterMember) clusterMember {
+	return founderBy(members, e.less)
+}
+
+// seedElection: the first --seed node founds. Everyone else waits for it; if it is not among
+// the members, the lowest address founds instead.
+type seedElection struct {
+	seedIPs []net.IP
+}
+
+func newSeedElection(cs *ClientState) *seedElection {
+	e := &seedElection{seedIPs: make([]net.IP, 0)}
+	if len(cs.cfg.Seeds) == 0 {
+		fmt.Printf("Seed election without --seed; falling back to lowest IP\n")
+		return e
+	}
+	seed := strings.TrimSpace(strings.Split(cs.cfg.Seeds[0], ",")[0])
+	host, _, err := net.SplitHostPort(seed)
+	if err != nil {
+		host = seed
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		e.seedIPs = append(e.seedIPs, ip)
+	} else if ips, err := net.LookupIP(host); err != nil {
+		fmt.Printf("Could not resolve preferred seed '%s': %s\n", host, err.Error())
+	} else {
+		e.seedIPs = ips
+	}
+	return e
+}
+
+func (e *seedElection) Name() string {
+	return "seed"
+}
+
+func (e *seedElection) isSeed(m clusterMember) bool {
+	for _, ip := range e.seedIPs {
+		if ip.Equal(m.peerIP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *seedElection) less(a clusterMember, b clusterMember) bool {
+	if e.isSeed(a) != e.isSeed(b) {
+		return e.isSeed(a)
+	}
+	return lowerIP(a, b)
+}
+
+func (e *seedElection) ShouldWait(self clusterMember, peer clusterMember) bool {
+	return e.less(peer, self)
+}
+
+func (e *seedElection) Founder(members []clusterMember) clusterMember {
+	return founderBy(members, e.less)
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+func TestCompareIP(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "10.0.0.9", b: "10.0.0.10", want: -1}, // numeric, not string, order
+		{a: "10.0.0.10", b: "10.0.0.9", want: 1},
+		{a: "10.0.1.1", b: "10.0.0.200", want: 1},
+		{a: "192.168.1.1", b: "192.168.1.1", want: 0},
+		{a: "::ffff:10.0.0.1", b: "10.0.0.1", want: 0}, // 4 and 16 byte forms of the same address
+	}
+	for _, tt := range tests {
+		if got := compareIP(net.ParseIP(tt.a), net.ParseIP(tt.b)); got != tt.want {
+			t.Errorf("compareIP(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestElectionFounder(t *testing.T) {
+	members := []clusterMember{
+		{name: "c", peerIP: net.ParseIP("10.0.0.10"), priority: 5},
+		{name: "a", peerIP: net.ParseIP("10.0.0.11")},
+		{name: "b", peerIP: net.ParseIP("10.0.0.9")},
+	}
+	tests := []struct {
+		election string
+		seeds    []string
+		want     string
+	}{
+		{election: "ip", want: "b"},
+		{election: "uuid", want: "a"},
+		{election: "priority", want: "c"},
+		{election: "seed", seeds: []string{"10.0.0.11:2379,10.0.0.10:2379"}, want: "a"},
+		{election: "seed", seeds: []string{"10.0.0.99"}, want: "b"}, // seed not among the members
+	}
+	for _, tt := range tests {
+		cs := newTestState(&common.Config{Election: tt.election, Seeds: tt.seeds}, nil)
+		e, err := newElectionStrategy(cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.Founder(members).name; got != tt.want {
+			t.Errorf("%s election with seeds %v: founder '%s', want '%s'", tt.election, tt.seeds, got, tt.want)
+		}
+		founder := e.Founder(members)
+		for _, m := range members {
+			if m.name != founder.name && (e.ShouldWait(founder, m) || !e.ShouldWait(m, founder)) {
+				t.Errorf("%s election: '%s' and founder '%s' disagree on who waits", tt.election, m.name, founder.name)
+			}
+		}
+	}
+	if _, err := newElectionStrategy(newTestState(&common.Config{Election: "oldest"}, nil)); err == nil {
+		t.Errorf("unknown election strategy accepted")
+	}
+}
@@ -0,0 +1,210 @@
+package client
+
+/*
+
+etcd discovery protocol client
+
+Speaks the discovery.etcd.io protocol against a discovery URL, so that cluster membership is known
+and logged before etcd is started, and etcd is handed an explicit peers list.
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type discoveryNode struct {
+	Key          string          `json:"key"`
+	Value        string          `json:"value"`
+	Dir          bool            `json:"dir"`
+	CreatedIndex uint64          `json:"createdIndex"`
+	Nodes        []discoveryNode `json:"nodes"`
+}
+
+type discoveryResponse struct {
+	Action string        `json:"action"`
+	Node   discoveryNode `json:"node"`
+}
+
+type discoveryMember struct {
+	ID      string // key under the token
+	Name    string // etcd name, if registered in name=url form
+	PeerURL string
+	Index   uint64
+}
+
+type discoveryClient struct {
+	url    string
+	client *http.Client
+}
+
+func newDiscoveryClient(u string, client *http.Client) *discoveryClient {
+	return &discoveryClient{url: strings.TrimSuffix(u, "/"), client: client}
+}
+
+func (d *discoveryClient) get(path string) (*discoveryResponse, int, error) {
+	resp, err := d.client.Get(d.url + path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("GET %s%s returned %s", d.url, path, resp.Status)
+	}
+	r := &discoveryResponse{}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("Error parsing discovery response: %s", err.Error())
+	}
+	return r, resp.StatusCode, nil
+}
+
+// size returns the expected cluster size for the token, or 0 if the token does not set one
+func (d *discoveryClient) size() (int, error) {
+	r, status, err := d.get("/_config/size")
+	if status == http.StatusNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	size, err := strconv.Atoi(r.Node.Value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid cluster size '%s' in discovery token", r.Node.Value)
+	}
+	return size, nil
+}
+
+func (d *discoveryClient) register(id string, name string, peerURL string) error {
+	form := url.Values{}
+	form.Set("value", fmt.Sprintf("%s=%s", name, peerURL))
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/%s", d.url, id), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("PUT %s/%s returned %s", d.url, id, resp.Status)
+	}
+	return nil
+}
+
+func (d *discoveryClient) members() ([]discoveryMember, error) {
+	r, _, err := d.get("")
+	if err != nil {
+		return nil, err
+	}
+	members := make([]discoveryMember, 0)
+	for _, n := range r.Node.Nodes {
+		key := n.Key[strings.LastIndex(n.Key, "/")+1:]
+		if n.Dir || strings.HasPrefix(key, "_") {
+			// _config and friends
+			continue
+		}
+		m := discoveryMember{ID: key, PeerURL: n.Value, Index: n.CreatedIndex}
+		// etcd 2 registers name=url, etcd 0.4 registers the bare url
+		if i := strings.Index(n.Value, "="); i >= 0 {
+			m.Name = n.Value[:i]
+			m.PeerURL = n.Value[i+1:]
+		}
+		members = append(members, m)
+	}
+	sort.Sort(membersByIndex(members))
+	return members, nil
+}
+
+type membersByIndex []discoveryMember
+
+func (m membersByIndex) Len() int           { return len(m) }
+func (m membersByIndex) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m membersByIndex) Less(i, j int) bool { return m[i].Index < m[j].Index }
+
+// joinDiscoveryCluster registers us under the discovery token and waits until the expected
+// number of members have registered, then records the other members as explicit peers.
+func (cs *ClientState) joinDiscoveryCluster(discoveryURL string) error {
+	d := newDiscoveryClient(discoveryURL, cs.prober.discovery())
+	size, err := d.size()
+	if err != nil {
+		return fmt.Errorf("Error reading cluster size from '%s': %s", discoveryURL, err.Error())
+	}
+
+	cs.etcd.SetupAddresses()
+	peerURL := cs.etcd.PeerURL()
+	if err := d.register(cs.cfg.UUID, cs.etcd.Name, peerURL); err != nil {
+		return fmt.Errorf("Error registering with '%s': %s", discoveryURL, err.Error())
+	}
+	fmt.Printf("Registered '%s' as %s with discovery URL '%s' (expected size %d)\n",
+		cs.etcd.Name, peerURL, discoveryURL, size)
+
+	deadline := time.Now().Add(time.Duration(cs.etcd.DiscoveryWait) * time.Second)
+	for {
+		members, err := d.members()
+		if err != nil {
+			fmt.Printf("Error listing members from '%s': %s\n", discoveryURL, err.Error())
+		} else if size == 0 || len(members) >= size {
+			if size > 0 {
+				members = members[:size]
+			}
+			return cs.useDiscoveryMembers(members)
+		} else {
+			fmt.Printf("Discovery URL has %d of %d members; waiting\n", len(members), size)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for %d members at '%s'", size, discoveryURL)
+		}
+		time.Sleep(cs.cfg.PollInterval)
+	}
+}
+
+func (cs *ClientState) useDiscoveryMembers(members []discoveryMember) error {
+	self := false
+	peers := make([]string, 0)
+	for _, m := range members {
+		fmt.Printf("Discovery member '%s': name '%s' peer URL %s\n", m.ID, m.Name, m.PeerURL)
+		if m.ID == cs.cfg.UUID {
+			self = true
+			continue
+		}
+		u, err := url.Parse(m.PeerURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("Invalid peer URL '%s' for member '%s'", m.PeerURL, m.ID)
+		}
+		peers = append(peers, u.Host)
+		name := m.Name
+		if name == "" {
+			name = m.ID
+		}
+		cs.etcd.InitialCluster[name] = m.PeerURL
+	}
+	if !self {
+		return fmt.Errorf("Cluster is already full without us (%d members)", len(members))
+	}
+	cs.etcd.Peers = peers
+	cs.etcd.InitialCluster[cs.etcd.Name] = cs.etcd.PeerURL()
+	cs.etcd.ClusterState = "new"
+	// the first to register founds, which matters for who issues certificates
+	if members[0].ID == cs.cfg.UUID {
+		cs.etcd.Founder = cs.etcd.Name
+	} else if members[0].Name != "" {
+		cs.etcd.Founder = members[0].Name
+	} else {
+		cs.etcd.Founder = members[0].ID
+	}
+	cs.etcd.DiscoveryURL = ""
+	return nil
+}
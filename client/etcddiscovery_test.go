@@ -0,0 +1,145 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+// fakeToken serves one discovery token the way discovery.etcd.io does
+type fakeToken struct {
+	mutex sync.Mutex
+	size  string // _config/size, or "" for none
+	keys  []string
+	nodes map[string]discoveryNode
+}
+
+func newFakeToken(size string, registered ...string) *fakeToken {
+	f := &fakeToken{size: size, nodes: make(map[string]discoveryNode)}
+	for i, value := range registered {
+		f.put(string(rune('a'+i)), value)
+	}
+	return f
+}
+
+func (f *fakeToken) put(id string, value string) {
+	if _, ok := f.nodes[id]; !ok {
+		f.keys = append(f.keys, id)
+	}
+	f.nodes[id] = discoveryNode{Key: "/_etcd/registry/token/" + id, Value: value, CreatedIndex: uint64(len(f.keys))}
+}
+
+func (f *fakeToken) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/token")
+	resp := discoveryResponse{Action: "get"}
+	switch {
+	case r.Method == "PUT":
+		f.put(strings.TrimPrefix(path, "/"), r.FormValue("value"))
+		resp = discoveryResponse{Action: "set", Node: f.nodes[strings.TrimPrefix(path, "/")]}
+	case path == "/_config/size" && f.size != "":
+		resp.Node = discoveryNode{Key: "/_etcd/registry/token/_config/size", Value: f.size}
+	case path == "" || path == "/":
+		resp.Node = discoveryNode{Key: "/_etcd/registry/token", Dir: true}
+		resp.Node.Nodes = append(resp.Node.Nodes, discoveryNode{Key: "/_etcd/registry/token/_config", Dir: true})
+		// listed out of registration order; members must be sorted by index
+		for i := len(f.keys) - 1; i >= 0; i-- {
+			resp.Node.Nodes = append(resp.Node.Nodes, f.nodes[f.keys[i]])
+		}
+	default:
+		http.Error(w, `{"errorCode":100,"message":"Key not found"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestDiscoverySize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int
+		wantErr bool
+	}{
+		{size: "3", want: 3},
+		{size: "", want: 0},
+		{size: "three", wantErr: true},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(newFakeToken(tt.size))
+		got, err := newDiscoveryClient(server.URL+"/token/", http.DefaultClient).size()
+		server.Close()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("size '%s': got %d, %v; want %d, error %v", tt.size, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestJoinDiscoveryCluster(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       string
+		registered []string
+		wantPeers  []string
+		wantErr    bool
+	}{
+		{
+			name:       "filled by us",
+			size:       "3",
+			registered: []string{"n1=http://10.0.0.1:7001", "http://10.0.0.2:7001"}, // etcd 2 and etcd 0.4 forms
+			wantPeers:  []string{"10.0.0.1:7001", "10.0.0.2:7001"},
+		},
+		{
+			name:       "no size",
+			registered: []string{"n1=http://10.0.0.1:7001"},
+			wantPeers:  []string{"10.0.0.1:7001"},
+		},
+		{
+			name:       "full without us",
+			size:       "2",
+			registered: []string{"n1=http://10.0.0.1:7001", "n2=http://10.0.0.2:7001"},
+			wantErr:    true,
+		},
+		{
+			name:       "never fills",
+			size:       "5",
+			registered: []string{"n1=http://10.0.0.1:7001"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid peer url",
+			size:       "2",
+			registered: []string{"n1=10.0.0.1"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		token := newFakeToken(tt.size, tt.registered...)
+		server := httptest.NewServer(token)
+		etcd := &common.EtcdConfig{Name: "self", ClientAddr: "10.0.0.9", PeerPort: 7001, DiscoveryURL: server.URL + "/token"}
+		cs := newTestState(&common.Config{UUID: "0a1b2c3d"}, etcd)
+		err := cs.joinDiscoveryCluster(server.URL + "/token")
+		server.Close()
+
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: joinDiscoveryCluster returned %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if self := token.nodes["0a1b2c3d"].Value; self != "self=http://10.0.0.9:7001" {
+			t.Errorf("%s: registered '%s', want self=http://10.0.0.9:7001", tt.name, self)
+		}
+		if tt.wantErr {
+			continue
+		}
+		if strings.Join(etcd.Peers, ",") != strings.Join(tt.wantPeers, ",") || etcd.DiscoveryURL != "" {
+			t.Errorf("%s: peers %v discovery URL '%s', want peers %v and no discovery URL", tt.name, etcd.Peers, etcd.DiscoveryURL, tt.wantPeers)
+		}
+		if len(etcd.InitialCluster) != len(tt.wantPeers)+1 || etcd.InitialCluster["self"] != "http://10.0.0.9:7001" || etcd.ClusterState != "new" {
+			t.Errorf("%s: initial cluster %v state '%s', want us and every peer, new", tt.name, etcd.InitialCluster, etcd.ClusterState)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"fmt"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"net"
+	"sort"
+)
+
+// When no running cluster is found, nodes found a new one. By default the lowest node founds
+// alone and the rest join it; which node counts as lowest is up to the --election strategy. In
+// --expect mode we keep collecting booting peers until the expected number of distinct nodes has
+// been seen, then every node derives the same member set and founder from what it saw; with
+// --handshake the founder's proposal is acknowledged by every member before anyone writes a conf.
+
+type clusterMember struct {
+	name     string
+	peerIP   net.IP
+	zone     string // interface a link-local peerIP was seen on
+	peerPort int
+	priority int
+}
+
+// seenMembers returns every distinct node seen, including us, sorted by name
+func (cs *ClientState) seenMembers() []clusterMember {
+	selfIP, selfZone := common.SplitZone(cs.etcd.PeerAddr)
+	byName := map[string]clusterMember{
+		cs.etcd.Name: clusterMember{name: cs.etcd.Name, peerIP: selfIP, zone: selfZone, peerPort: cs.etcd.PeerPort, priority: cs.cfg.Priority},
+	}
+	keys := make([]string, 0, len(cs.etcd.BootingPeers))
+	for k, _ := range cs.etcd.BootingPeers {
+		keys = append(keys, k)
+	}
+	// multi-homed peers appear once per address; keep the same one every time
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := cs.etcd.BootingPeers[k]
+		if _, ok := byName[p.Name]; !ok {
+			byName[p.Name] = clusterMember{name: p.Name, peerIP: p.PeerIP, zone: p.Zone(), peerPort: p.PeerPort, priority: p.Priority}
+		}
+	}
+
+	members := make([]clusterMember, 0, len(byName))
+	for _, m := range byName {
+		members = append(members, m)
+	}
+	sort.Sort(clusterMembersByName(members))
+	return members
+}
+
+type clusterMembersByName []clusterMember
+
+func (m clusterMembersByName) Len() int           { return len(m) }
+func (m clusterMembersByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m clusterMembersByName) Less(i, j int) bool { return m[i].name < m[j].name }
+
+// proposedMembers is the member set we would found with: everyone seen, limited to the first
+// --expect nodes by name so that every node arrives at the same set
+func (cs *ClientState) proposedMembers() []clusterMember {
+	cs.etcd.SetupAddresses()
+	members := cs.seenMembers()
+	if cs.cfg.Expect > 0 && len(members) > cs.cfg.Expect {
+		members = members[:cs.cfg.Expect]
+	}
+	return members
+}
+
+// found settles the member set for a new cluster
+func (cs *ClientState) found() error {
+	if cs.cfg.Expect == 0 && !cs.cfg.Handshake {
+		return nil
+	}
+	members := cs.proposedMembers()
+	// without --expect the members seen may differ from node to node, but nodes that saw each
+	// other agree on the founder, and the others wait for its proposal
+	founder := cs.election.Founder(members).name
+	if cs.cfg.Handshake {
+		var err error
+		if members, founder, err = cs.handshake(members, founder); err != nil {
+			return err
+		}
+	}
+	return cs.foundCluster(members, founder)
+}
+
+// foundCluster writes the whole member set into the conf, so every node starts with an
+// identical initial cluster.
+func (cs *ClientState) foundCluster(members []clusterMember, founder string) error {
+	self := false
+	peers := make([]string, 0)
+	initialCluster := make(map[string]string)
+	for _, m := range members {
+		if m.name == cs.etcd.Name {
+			self = true
+			initialCluster[m.name] = cs.etcd.PeerURL()
+		} else {
+			initialCluster[m.name] = fmt.Sprintf("%s://%s", cs.etcd.Scheme(), common.URLHost(m.peerIP, m.zone, m.peerPort))
+			peers = append(peers, common.HostPort(m.peerIP, m.zone, m.peerPort))
+		}
+	}
+	if !self {
+		return fmt.Errorf("Cluster of %d was founded without us", len(members))
+	}
+
+	fmt.Printf("Founding cluster of %d with founder '%s'\n", len(members), founder)
+	for _, m := range members {
+		fmt.Printf("Cluster member '%s' at %s\n", m.name, initialCluster[m.name])
+	}
+	cs.etcd.Peers = peers
+	cs.etcd.InitialCluster = initialCluster
+	cs.etcd.ClusterState = "new"
+	cs.etcd.Founder = founder
+	return nil
+}
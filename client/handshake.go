@@ -0,0 +1,376 @@
+package client
+
+/*
+
+Founding handshake
+
+Before anyone writes a conf for a new cluster, the founder proposes the member set and every
+member acknowledges it:
+
+	founder -> members   propose  {cluster, founder, members}
+	member  -> founder   ack      {cluster}
+	founder -> members   commit   {cluster, founder, members}
+
+The cluster id is derived from the founder and member names, so a re-sent proposal is recognised
+as the same one. A member acknowledges the proposal whose founder wins the election and that
+includes it, and abandons its own proposal if it sees one with a better founder. Messages are
+JSON over UDP on --handshake_port; the transport is an interface so the protocol can run over a
+simulated network.
+
+With --join_secret every message carries ts and hmac, like our announcements, and messages that
+do not verify are dropped, so that a host without the secret cannot propose or commit a member
+set.
+
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	handshakePropose = "propose"
+	handshakeAck     = "ack"
+	handshakeCommit  = "commit"
+)
+
+const handshakeResend = 500 * time.Millisecond
+
+// signed messages older than this are replays
+const handshakeMaxAge = 60 * time.Second
+
+type handshakeMember struct {
+	Name     string `json:"name"`
+	PeerIP   string `json:"peer_ip"`
+	Zone     string `json:"zone,omitempty"` // interface the sender reaches a link-local PeerIP on
+	PeerPort int    `json:"peer_port"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+type handshakeMessage struct {
+	Type    string            `json:"type"`
+	Cluster string            `json:"cluster"`
+	Founder string            `json:"founder"`
+	From    string            `json:"from"`
+	Members []handshakeMember `json:"members,omitempty"`
+	TS      int64             `json:"ts,omitempty"`
+	MAC     string            `json:"hmac,omitempty"`
+}
+
+// handshakeMAC signs everything in the message but the MAC itself
+func handshakeMAC(secret string, msg *handshakeMessage) string {
+	unsigned := *msg
+	unsigned.MAC = ""
+	data, _ := json.Marshal(&unsigned)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "handshake|%s", data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signed returns a signed copy of msg; messages are re-sent, and each copy gets a fresh ts
+func (cs *ClientState) signed(msg *handshakeMessage) *handshakeMessage {
+	if cs.cfg.JoinSecret == "" {
+		return msg
+	}
+	signed := *msg
+	signed.TS = time.Now().Unix()
+	signed.MAC = handshakeMAC(cs.cfg.JoinSecret, &signed)
+	return &signed
+}
+
+// checkHandshake verifies a received message the same way as an announcement
+func (cs *ClientState) checkHandshake(msg *handshakeMessage) error {
+	if cs.cfg.JoinSecret == "" {
+		return nil
+	}
+	if msg.MAC == "" {
+		return fmt.Errorf("not signed")
+	}
+	if !hmac.Equal([]byte(msg.MAC), []byte(handshakeMAC(cs.cfg.JoinSecret, msg))) {
+		return fmt.Errorf("signature does not verify")
+	}
+	age := time.Since(time.Unix(msg.TS, 0))
+	if age > handshakeMaxAge || age < -handshakeMaxAge {
+		return fmt.Errorf("timestamp is %s out", age.String())
+	}
+	return nil
+}
+
+func newProposal(founder string, members []clusterMember) *handshakeMessage {
+	names := make([]string, 0, len(members))
+	msg := &handshakeMessage{Type: handshakePropose, Founder: founder, From: founder}
+	for _, m := range members {
+		names = append(names, m.name)
+		msg.Members = append(msg.Members, handshakeMember{Name: m.name, PeerIP: m.peerIP.String(), Zone: m.zone, PeerPort: m.peerPort, Priority: m.priority})
+	}
+	sort.Strings(names)
+	sum := sha1.Sum([]byte(founder + "|" + strings.Join(names, ",")))
+	msg.Cluster = hex.EncodeToString(sum[:8])
+	return msg
+}
+
+func (msg *handshakeMessage) includes(name string) bool {
+	for _, m := range msg.Members {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (msg *handshakeMessage) clusterMembers() []clusterMember {
+	members := make([]clusterMember, 0, len(msg.Members))
+	for _, m := range msg.Members {
+		members = append(members, clusterMember{name: m.Name, peerIP: net.ParseIP(m.PeerIP), zone: m.Zone, peerPort: m.PeerPort, priority: m.Priority})
+	}
+	sort.Sort(clusterMembersByName(members))
+	return members
+}
+
+// localZones replaces the sender's interface names with ours, for ourselves and every member we
+// saw while polling. Zones only name interfaces on the host that found the address; a member we
+// did not see keeps the sender's, which is right where hosts name their interfaces alike.
+func (cs *ClientState) localZones(msg *handshakeMessage) {
+	zones := make(map[string]string)
+	for _, p := range cs.etcd.BootingPeers {
+		zones[p.Name] = p.Zone()
+	}
+	_, zones[cs.etcd.Name] = common.SplitZone(cs.etcd.PeerAddr)
+	for i, m := range msg.Members {
+		if zone, ok := zones[m.Name]; ok {
+			msg.Members[i].Zone = zone
+		}
+	}
+}
+
+func (msg *handshakeMessage) member(name string) (clusterMember, bool) {
+	for _, m := range msg.clusterMembers() {
+		if m.name == name {
+			return m, true
+		}
+	}
+	return clusterMember{}, false
+}
+
+// betterFounder reports whether msg's founder wins the election against other's
+func (cs *ClientState) betterFounder(msg *handshakeMessage, other *handshakeMessage) bool {
+	founder, _ := msg.member(msg.Founder)
+	otherFounder, _ := other.member(other.Founder)
+	return cs.election.ShouldWait(otherFounder, founder)
+}
+
+// handshakeTransport delivers handshake messages between members
+type handshakeTransport interface {
+	send(to clusterMember, msg *handshakeMessage) error
+	inbox() <-chan *handshakeMessage
+	close()
+}
+
+type udpHandshakeTransport struct {
+	conn *net.UDPConn
+	port int
+	in   chan *handshakeMessage
+}
+
+func newUDPHandshakeTransport(port int) (*udpHandshakeTransport, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("Could not listen for founding handshake on port %d: %s", port, err.Error())
+	}
+	t := &udpHandshakeTransport{conn: conn, port: port, in: make(chan *handshakeMessage, 64)}
+	go t.listen()
+	return t, nil
+}
+
+func (t *udpHandshakeTransport) listen() {
+	defer close(t.in)
+	buf := make([]byte, 65536)
+	for {
+		n, src, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg := &handshakeMessage{}
+		if err := json.Unmarshal(buf[:n], msg); err != nil {
+			fmt.Printf("Ignoring handshake packet from %s: %s\n", src.String(), err.Error())
+			continue
+		}
+		t.in <- msg
+	}
+}
+
+func (t *udpHandshakeTransport) send(to clusterMember, msg *handshakeMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	addr := &net.UDPAddr{IP: to.peerIP, Port: t.port}
+	if common.IsIPv6LinkLocal(to.peerIP) {
+		addr.Zone = to.zone
+	}
+	_, err = t.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (t *udpHandshakeTransport) inbox() <-chan *handshakeMessage {
+	return t.in
+}
+
+func (t *udpHandshakeTransport) close() {
+	t.conn.Close()
+}
+
+// startHandshake listens for proposals from the start, since another node may begin founding
+// while we are still polling
+func (cs *ClientState) startHandshake() error {
+	t, err := newUDPHandshakeTransport(cs.cfg.HandshakePort)
+	if err != nil {
+		return err
+	}
+	cs.useHandshakeTransport(t)
+	return nil
+}
+
+func (cs *ClientState) useHandshakeTransport(t handshakeTransport) {
+	cs.transport = t
+	cs.proposalSeen = make(chan bool, 1)
+	cs.handshakeInbox = make(chan *handshakeMessage, 64)
+	go func() {
+		for msg := range t.inbox() {
+			if err := cs.checkHandshake(msg); err != nil {
+				fmt.Printf("Ignoring handshake %s from '%s': %s\n", msg.Type, msg.From, err.Error())
+				continue
+			}
+			if msg.Type == handshakePropose && msg.includes(cs.etcd.Name) {
+				select {
+				case cs.proposalSeen <- true:
+				default:
+				}
+			}
+			cs.handshakeInbox <- msg
+		}
+	}()
+}
+
+func (cs *ClientState) stopHandshake() {
+	if cs.transport != nil {
+		cs.transport.close()
+		cs.transport = nil
+	}
+}
+
+func (cs *ClientState) sendHandshake(to clusterMember, msg *handshakeMessage) {
+	if err := cs.transport.send(to, cs.signed(msg)); err != nil {
+		fmt.Printf("Error sending handshake %s to '%s': %s\n", msg.Type, to.name, err.Error())
+	}
+}
+
+// handshake agrees the member set with the other members. If we are the founder we propose
+// members; otherwise we wait for a proposal. Returns the committed members and founder.
+func (cs *ClientState) handshake(members []clusterMember, founder string) ([]clusterMember, string, error) {
+	self := cs.etcd.Name
+	var current *handshakeMessage
+	leading := founder == self
+	if leading {
+		current = newProposal(self, members)
+		fmt.Printf("Proposing cluster %s with %d members\n", current.Cluster, len(current.Members))
+	} else {
+		fmt.Printf("Waiting for a founding proposal from '%s'\n", founder)
+	}
+	acks := map[string]bool{self: true}
+
+	commit := func(msg *handshakeMessage) ([]clusterMember, string, error) {
+		if leading {
+			commitMsg := *msg
+			commitMsg.Type = handshakeCommit
+			commitMsg.From = self
+			// commits are not acknowledged; send a few in case one is lost
+			for i := 0; i < 3; i++ {
+				for _, m := range msg.clusterMembers() {
+					if m.name != self {
+						cs.sendHandshake(m, &commitMsg)
+					}
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		fmt.Printf("Cluster %s committed by '%s'\n", msg.Cluster, msg.Founder)
+		return msg.clusterMembers(), msg.Founder, nil
+	}
+	ackFounder := func() {
+		if to, ok := current.member(current.Founder); ok {
+			cs.sendHandshake(to, &handshakeMessage{Type: handshakeAck, Cluster: current.Cluster, Founder: current.Founder, From: self})
+		}
+	}
+
+	if leading {
+		for _, m := range members {
+			if m.name != self {
+				cs.sendHandshake(m, current)
+			}
+		}
+	}
+
+	ticker := time.NewTicker(handshakeResend)
+	defer ticker.Stop()
+	deadline := time.After(cs.cfg.ProposalWait)
+	for {
+		if leading && len(acks) >= len(current.Members) {
+			return commit(current)
+		}
+		select {
+		case msg := <-cs.handshakeInbox:
+			cs.localZones(msg)
+			switch msg.Type {
+			case handshakePropose:
+				if !msg.includes(self) {
+					fmt.Printf("Ignoring proposal %s from '%s': we are not a member\n", msg.Cluster, msg.Founder)
+				} else if current == nil || cs.betterFounder(msg, current) || (msg.Founder == current.Founder && !leading) {
+					if leading {
+						fmt.Printf("Abandoning our proposal; '%s' proposed %s\n", msg.Founder, msg.Cluster)
+						leading = false
+					}
+					current = msg
+					ackFounder()
+				} else {
+					fmt.Printf("Ignoring proposal %s from '%s': founder '%s' wins the election\n", msg.Cluster, msg.Founder, current.Founder)
+				}
+			case handshakeAck:
+				if leading && msg.Cluster == current.Cluster && current.includes(msg.From) && !acks[msg.From] {
+					acks[msg.From] = true
+					fmt.Printf("Proposal %s acknowledged by '%s' (%d of %d)\n", current.Cluster, msg.From, len(acks), len(current.Members))
+				}
+			case handshakeCommit:
+				// a commit for a proposal we never saw is still good if it is no worse than ours
+				if msg.includes(self) && (current == nil || msg.Cluster == current.Cluster || cs.betterFounder(msg, current)) {
+					leading = false
+					return commit(msg)
+				}
+			}
+		case <-ticker.C:
+			if leading {
+				for _, m := range current.clusterMembers() {
+					if !acks[m.name] {
+						cs.sendHandshake(m, current)
+					}
+				}
+			} else if current != nil {
+				ackFounder()
+			}
+		case <-deadline:
+			if leading {
+				return nil, "", fmt.Errorf("Founding handshake timed out with %d of %d members acknowledging", len(acks), len(current.Members))
+			}
+			return nil, "", fmt.Errorf("Founding handshake timed out waiting for a commit")
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+// simNetwork delivers handshake messages between ClientStates in memory. drop, if set, decides
+// which messages are lost.
+type simNetwork struct {
+	mutex sync.Mutex
+	nodes map[string]*simTransport
+	drop  func(from string, to string, msg *handshakeMessage) bool
+}
+
+type simTransport struct {
+	network *simNetwork
+	name    string
+	in      chan *handshakeMessage
+	closed  bool
+}
+
+func newSimNetwork() *simNetwork {
+	return &simNetwork{nodes: make(map[string]*simTransport)}
+}
+
+func (n *simNetwork) join(name string) *simTransport {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	t := &simTransport{network: n, name: name, in: make(chan *handshakeMessage, 256)}
+	n.nodes[name] = t
+	return t
+}
+
+func (t *simTransport) send(to clusterMember, msg *handshakeMessage) error {
+	// through JSON, as on the wire, so that nobody shares the sender's message
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	received := &handshakeMessage{}
+	json.Unmarshal(data, received)
+
+	n := t.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.drop != nil && n.drop(t.name, to.name, received) {
+		return nil
+	}
+	if dest, ok := n.nodes[to.name]; ok && !dest.closed {
+		select {
+		case dest.in <- received:
+		default:
+		}
+	}
+	return nil
+}
+
+func (t *simTransport) inbox() <-chan *handshakeMessage {
+	return t.in
+}
+
+func (t *simTransport) close() {
+	t.network.mutex.Lock()
+	defer t.network.mutex.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.in)
+	}
+}
+
+type simNode struct {
+	name string
+	ip   string
+	sees []string // names of the other nodes it saw while polling
+}
+
+// newSimState builds a node that has polled and seen the given peers as booting
+func newSimState(network *simNetwork, node simNode, all map[string]simNode, expect int, secret string) *ClientState {
+	cfg := &common.Config{Expect: expect, Handshake: true, ProposalWait: 5 * time.Second, JoinSecret: secret}
+	etcd := &common.EtcdConfig{Name: node.name, ClientAddr: node.ip, PeerAddr: node.ip, ClientPort: 2379, PeerPort: 2380, ConfFormat: "env"}
+	cs := newTestState(cfg, etcd)
+	cs.election = &lowestIPElection{}
+	for _, name := range node.sees {
+		etcd.AddBootingPeer(name, nil, net.ParseIP(node.ip), net.ParseIP(all[name].ip), 2380, 0)
+	}
+	cs.useHandshakeTransport(network.join(node.name))
+	return cs
+}
+
+type simResult struct {
+	founder string
+	members string
+	err     error
+}
+
+// runFounding runs found() on every node at once, as after a simultaneous boot
+func runFounding(network *simNetwork, nodes []simNode, expect int, secret string) map[string]simResult {
+	all := make(map[string]simNode)
+	for _, node := range nodes {
+		all[node.name] = node
+	}
+	states := make([]*ClientState, 0, len(nodes))
+	for _, node := range nodes {
+		states = append(states, newSimState(network, node, all, expect, secret))
+	}
+
+	results := make(map[string]simResult)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, cs := range states {
+		wg.Add(1)
+		go func(cs *ClientState) {
+			defer wg.Done()
+			err := cs.found()
+			names := make([]string, 0)
+			for name, _ := range cs.etcd.InitialCluster {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			mutex.Lock()
+			results[cs.etcd.Name] = simResult{founder: cs.etcd.Founder, members: strings.Join(names, ","), err: err}
+			mutex.Unlock()
+		}(cs)
+	}
+	wg.Wait()
+	for _, cs := range states {
+		cs.stopHandshake()
+	}
+	return results
+}
+
+func TestHandshake(t *testing.T) {
+	a := simNode{name: "a", ip: "10.0.0.9", sees: []string{"b", "c"}}
+	b := simNode{name: "b", ip: "10.0.0.10", sees: []string{"a", "c"}}
+	c := simNode{name: "c", ip: "10.0.0.11", sees: []string{"a", "b"}}
+	tests := []struct {
+		name        string
+		nodes       []simNode
+		expect      int
+		secret      string
+		drop        func(from string, to string, msg *handshakeMessage) bool
+		wantFounder string
+		wantMembers string
+	}{
+		{
+			name:        "expect",
+			nodes:       []simNode{a, b, c},
+			expect:      3,
+			wantFounder: "a",
+			wantMembers: "a,b,c",
+		},
+		{
+			// every node stops polling at about the same time; only the elected one proposes
+			name:        "no expect",
+			nodes:       []simNode{a, b, c},
+			wantFounder: "a",
+			wantMembers: "a,b,c",
+		},
+		{
+			// c never saw a, so would elect b, but takes a's proposal that includes it
+			name: "no expect, partial view",
+			nodes: []simNode{a, b,
+				{name: "c", ip: "10.0.0.11", sees: []string{"b"}}},
+			wantFounder: "a",
+			wantMembers: "a,b,c",
+		},
+		{
+			name:   "lossy",
+			nodes:  []simNode{a, b, c},
+			expect: 3,
+			drop: func() func(string, string, *handshakeMessage) bool {
+				dropped := make(map[string]bool)
+				// lose the first copy of each proposal and ack; resends must recover
+				return func(from string, to string, msg *handshakeMessage) bool {
+					key := from + ">" + to + ":" + msg.Type
+					if msg.Type == handshakeCommit || dropped[key] {
+						return false
+					}
+					dropped[key] = true
+					return true
+				}
+			}(),
+			wantFounder: "a",
+			wantMembers: "a,b,c",
+		},
+		{
+			name:        "signed",
+			nodes:       []simNode{a, b, c},
+			expect:      3,
+			secret:      "s3cret",
+			wantFounder: "a",
+			wantMembers: "a,b,c",
+		},
+	}
+	for _, tt := range tests {
+		network := newSimNetwork()
+		network.drop = tt.drop
+		results := runFounding(network, tt.nodes, tt.expect, tt.secret)
+		for name, r := range results {
+			if r.err != nil {
+				t.Errorf("%s: node %s: %s", tt.name, name, r.err.Error())
+			} else if r.founder != tt.wantFounder || r.members != tt.wantMembers {
+				t.Errorf("%s: node %s founded with '%s' members %s; want '%s' members %s",
+					tt.name, name, r.founder, r.members, tt.wantFounder, tt.wantMembers)
+			}
+		}
+	}
+}
+
+func TestHandshakeRejectsForgery(t *testing.T) {
+	nodes := []simNode{
+		{name: "a", ip: "10.0.0.1", sees: []string{"b"}},
+		{name: "b", ip: "10.0.0.2", sees: []string{"a"}},
+	}
+	forged := &handshakeMessage{
+		Type:    handshakeCommit,
+		Cluster: "f0f0f0f0f0f0f0f0",
+		Founder: "mallory",
+		From:    "mallory",
+		Members: []handshakeMember{
+			{Name: "mallory", PeerIP: "10.0.0.66", PeerPort: 2380},
+			{Name: "a", PeerIP: "10.0.0.1", PeerPort: 2380},
+			{Name: "b", PeerIP: "10.0.0.2", PeerPort: 2380},
+		},
+	}
+	tests := []struct {
+		name   string
+		sign   string // secret mallory signs with, if any
+		expect int
+	}{
+		{name: "unsigned", expect: 2},
+		{name: "wrong secret", sign: "guess", expect: 2},
+		{name: "unsigned, no expect", expect: 0},
+	}
+	for _, tt := range tests {
+		network := newSimNetwork()
+		mallory := network.join("mallory")
+		msg := *forged
+		if tt.sign != "" {
+			msg.TS = time.Now().Unix()
+			msg.MAC = handshakeMAC(tt.sign, &msg)
+		}
+		all := make(map[string]simNode)
+		for _, node := range nodes {
+			all[node.name] = node
+		}
+		states := make([]*ClientState, 0)
+		for _, node := range nodes {
+			cs := newSimState(network, node, all, tt.expect, "s3cret")
+			// the forged commit arrives before anyone has proposed
+			mallory.send(clusterMember{name: node.name}, &msg)
+			states = append(states, cs)
+		}
+		var wg sync.WaitGroup
+		errs := make([]error, len(states))
+		for i, cs := range states {
+			wg.Add(1)
+			go func(i int, cs *ClientState) {
+				defer wg.Done()
+				errs[i] = cs.found()
+			}(i, cs)
+		}
+		wg.Wait()
+		for i, cs := range states {
+			cs.stopHandshake()
+			if errs[i] != nil {
+				t.Errorf("%s: node %s: %s", tt.name, cs.etcd.Name, errs[i].Error())
+				continue
+			}
+			if _, ok := cs.etcd.InitialCluster["mallory"]; ok || cs.etcd.Founder != "a" {
+				t.Errorf("%s: node %s founded with '%s' members %v", tt.name, cs.etcd.Name, cs.etcd.Founder, cs.etcd.InitialCluster)
+			}
+		}
+	}
+}
+
+func TestHandshakeSignature(t *testing.T) {
+	cs := newTestState(&common.Config{JoinSecret: "s3cret"}, nil)
+	msg := newProposal("a", []clusterMember{{name: "a", peerIP: net.ParseIP("10.0.0.1"), peerPort: 2380}})
+	signed := cs.signed(msg)
+	if err := cs.checkHandshake(signed); err != nil {
+		t.Errorf("own signature: %s", err.Error())
+	}
+
+	tampered := *signed
+	tampered.Members = append(append([]handshakeMember{}, signed.Members...), handshakeMember{Name: "mallory", PeerIP: "10.0.0.66"})
+	old := *msg
+	old.TS = time.Now().Add(-2 * handshakeMaxAge).Unix()
+	old.MAC = handshakeMAC("s3cret", &old)
+	for name, m := range map[string]*handshakeMessage{"unsigned": msg, "tampered": &tampered, "stale": &old} {
+		if err := cs.checkHandshake(m); err == nil {
+			t.Errorf("%s message verified", name)
+		} else {
+			t.Logf("%s message rejected: %s", name, err.Error())
+		}
+	}
+}
+
+func TestHandshakeZones(t *testing.T) {
+	members := []clusterMember{
+		{name: "a", peerIP: net.ParseIP("fe80::1"), zone: "eth0", peerPort: 2380},
+		{name: "b", peerIP: net.ParseIP("fe80::2"), zone: "eth0", peerPort: 2380},
+		{name: "c", peerIP: net.ParseIP("fe80::3"), zone: "eth0", peerPort: 2380},
+	}
+	data, err := json.Marshal(newProposal("a", members))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &handshakeMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msg.clusterMembers() {
+		if m.zone != "eth0" {
+			t.Errorf("member '%s' arrived with zone '%s', want the sender's eth0", m.name, m.zone)
+		}
+	}
+
+	// b saw a on its own br0, and is itself on eth1; c it never saw
+	cs := newTestState(&common.Config{}, &common.EtcdConfig{Name: "b", PeerAddr: "fe80::2%eth1"})
+	cs.etcd.AddBootingPeer("a", &net.Interface{Name: "br0"}, net.ParseIP("fe80::2"), net.ParseIP("fe80::1"), 2380, 0)
+	cs.localZones(msg)
+	want := map[string]string{"a": "br0", "b": "eth1", "c": "eth0"}
+	for _, m := range msg.clusterMembers() {
+		if m.zone != want[m.name] {
+			t.Errorf("member '%s' has zone '%s' after localZones, want '%s'", m.name, m.zone, want[m.name])
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package client
+
+/*
+
+etcd members API client
+
+etcd 2+ only lets a new node into a running cluster once it has been added through the members
+API, so we do that before writing the conf, and take the initial cluster from the member list.
+
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type etcdMember struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	PeerURLs   []string `json:"peerURLs"`
+	ClientURLs []string `json:"clientURLs"`
+}
+
+type etcdMemberList struct {
+	Members []etcdMember `json:"members"`
+}
+
+type membersClient struct {
+	endpoint string // client URL of a running member
+	client   *http.Client
+}
+
+func newMembersClient(endpoint string, client *http.Client) *membersClient {
+	return &membersClient{endpoint: strings.TrimSuffix(endpoint, "/"), client: client}
+}
+
+// list returns the members and the cluster ID reported by the server
+func (m *membersClient) list() ([]etcdMember, string, error) {
+	resp, err := m.client.Get(m.endpoint + "/v2/members")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("GET %s/v2/members returned %s", m.endpoint, resp.Status)
+	}
+	list := &etcdMemberList{}
+	if err := json.Unmarshal(body, list); err != nil {
+		return nil, "", fmt.Errorf("Error parsing member list: %s", err.Error())
+	}
+	return list.Members, resp.Header.Get("X-Etcd-Cluster-Id"), nil
+}
+
+// add registers a new member by peer URL. Being a member already is not an error.
+func (m *membersClient) add(peerURL string) (bool, error) {
+	body, _ := json.Marshal(map[string][]string{"peerURLs": []string{peerURL}})
+	resp, err := m.client.Post(m.endpoint+"/v2/members", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("POST %s/v2/members returned %s: %s", m.endpoint, resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+// remove deletes a member by ID. Being gone already is not an error.
+func (m *membersClient) remove(id string) (bool, error) {
+	req, err := http.NewRequest("DELETE", m.endpoint+"/v2/members/"+id, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return true, nil
+	case http.StatusNotFound, http.StatusGone:
+		return false, nil
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("DELETE %s/v2/members/%s returned %s: %s", m.endpoint, id, resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+// getJSON fetches path from the member and decodes the reply into v
+func (m *membersClient) getJSON(path string, v interface{}) error {
+	resp, err := m.client.Get(m.endpoint + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s%s returned %s", m.endpoint, path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("Error parsing %s%s: %s", m.endpoint, path, err.Error())
+	}
+	return nil
+}
+
+// leader reports whether the member is the cluster leader, from its own stats
+func (m *membersClient) leader() (bool, error) {
+	stats := struct {
+		State string `json:"state"`
+	}{}
+	if err := m.getJSON("/v2/stats/self", &stats); err != nil {
+		return false, err
+	}
+	return stats.State == "StateLeader", nil
+}
+
+// health asks the member's etcd whether it is healthy, which it only is while it is in a
+// cluster with a leader; merely answering is not enough
+func (m *membersClient) health() error {
+	health := struct {
+		Health string `json:"health"`
+	}{}
+	if err := m.getJSON("/health", &health); err != nil {
+		return err
+	}
+	if health.Health != "true" {
+		return fmt.Errorf("%s/health reports '%s'", m.endpoint, health.Health)
+	}
+	return nil
+}
+
+// joinCluster adds us to the running cluster through one of the server peers, then builds the
+// initial cluster from the member list it reports.
+func (cs *ClientState) joinCluster() error {
+	cs.etcd.SetupAddresses()
+	peerURL := cs.etcd.PeerURL()
+
+	keys := make([]string, 0, len(cs.etcd.ServerPeers))
+	for k, _ := range cs.etcd.ServerPeers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		peer := cs.etcd.ServerPeers[k]
+		m := newMembersClient(fmt.Sprintf("%s://%s", cs.etcd.Scheme(), common.URLHost(peer.PeerIP, peer.Zone(), peer.ClientPort)), cs.prober.lan())
+		added, err := m.add(peerURL)
+		if err != nil {
+			fmt.Printf("Could not join cluster through '%s': %s\n", m.endpoint, err.Error())
+			continue
+		}
+		if added {
+			fmt.Printf("Added ourselves (%s) to the cluster through '%s'\n", peerURL, m.endpoint)
+		} else {
+			fmt.Printf("Already a member of the cluster at '%s' as %s\n", m.endpoint, peerURL)
+		}
+
+		members, clusterID, err := m.list()
+		if err != nil {
+			fmt.Printf("Could not list members through '%s': %s\n", m.endpoint, err.Error())
+			continue
+		}
+		return cs.useClusterMembers(members, clusterID, peerURL)
+	}
+	return fmt.Errorf("Could not join the cluster through any of %d server peers", len(keys))
+}
+
+func (cs *ClientState) useClusterMembers(members []etcdMember, clusterID string, peerURL string) error {
+	initialCluster := make(map[string]string)
+	unstarted := make([]string, 0)
+	for _, member := range members {
+		self := false
+		for _, u := range member.PeerURLs {
+			self = self || u == peerURL
+		}
+		name := member.Name
+		if self {
+			name = cs.etcd.Name
+		}
+		if name == "" {
+			// added but not started yet, so it has no name; etcd still wants its URLs listed
+			fmt.Printf("Member %s (%s) has not started yet\n", member.ID, strings.Join(member.PeerURLs, ","))
+			unstarted = append(unstarted, member.PeerURLs...)
+			continue
+		}
+		if self {
+			initialCluster[name] = peerURL
+		} else if len(member.PeerURLs) > 0 {
+			initialCluster[name] = member.PeerURLs[0]
+		}
+		fmt.Printf("Cluster member %s: name '%s' peer URLs %s\n", member.ID, name, strings.Join(member.PeerURLs, ","))
+	}
+	if _, ok := initialCluster[cs.etcd.Name]; !ok {
+		return fmt.Errorf("We (%s) are missing from the member list", peerURL)
+	}
+	sort.Strings(unstarted)
+	cs.etcd.InitialCluster = initialCluster
+	cs.etcd.UnstartedPeers = unstarted
+	cs.etcd.ClusterState = "existing"
+	cs.etcd.ClusterID = clusterID
+	return nil
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+// fakeMembers stands in for the etcd v2 members API of a running cluster
+type fakeMembers struct {
+	mutex      sync.Mutex
+	members    []etcdMember
+	nextID     int
+	failStatus int  // if set, POST and DELETE fail with this status
+	leader     bool // what /v2/stats/self reports
+	unhealthy  bool // what /health reports
+}
+
+func (f *fakeMembers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	w.Header().Set("X-Etcd-Cluster-Id", "cdf818194e3a8c32")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v2/members":
+		json.NewEncoder(w).Encode(&etcdMemberList{Members: f.members})
+	case r.Method == "POST" && r.URL.Path == "/v2/members":
+		if f.failStatus != 0 {
+			http.Error(w, "no leader", f.failStatus)
+			return
+		}
+		req := struct {
+			PeerURLs []string `json:"peerURLs"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.PeerURLs) != 1 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		for _, m := range f.members {
+			for _, u := range m.PeerURLs {
+				if u == req.PeerURLs[0] {
+					http.Error(w, "peerURL exists", http.StatusConflict)
+					return
+				}
+			}
+		}
+		f.nextID++
+		m := etcdMember{ID: fmt.Sprintf("new%d", f.nextID), PeerURLs: req.PeerURLs, ClientURLs: []string{}}
+		f.members = append(f.members, m)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&m)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/v2/members/"):
+		if f.failStatus != 0 {
+			http.Error(w, "no leader", f.failStatus)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/v2/members/")
+		for i, m := range f.members {
+			if m.ID == id {
+				f.members = append(f.members[:i], f.members[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "member not found", http.StatusNotFound)
+	case r.Method == "GET" && r.URL.Path == "/v2/stats/self":
+		state := "StateFollower"
+		if f.leader {
+			state = "StateLeader"
+		}
+		fmt.Fprintf(w, `{"name":"us","state":"%s"}`, state)
+	case r.Method == "GET" && r.URL.Path == "/health":
+		fmt.Fprintf(w, `{"health":"%v"}`, !f.unhealthy)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// startFakeMembers listens on ip, so that a test can also have a dead peer on the same port
+func startFakeMembers(t *testing.T, ip string, f *fakeMembers) (*httptest.Server, int) {
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %s", ip, err.Error())
+	}
+	server := httptest.NewUnstartedServer(f)
+	server.Listener.Close()
+	server.Listener = l
+	server.Start()
+	return server, l.Addr().(*net.TCPAddr).Port
+}
+
+func TestJoinCluster(t *testing.T) {
+	const ourURL = "http://10.0.0.5:2380"
+	running := etcdMember{ID: "a1", Name: "a", PeerURLs: []string{"http://10.0.0.1:2380"}, ClientURLs: []string{"http://10.0.0.1:2379"}}
+	tests := []struct {
+		name       string
+		members    []etcdMember
+		failStatus int
+		deadFirst  bool // the first server peer in order is not listening
+		want       map[string]string
+		wantAdded  []string // unstarted members' peer URLs
+		wantErr    bool
+		wantCount  int // members the API ends with
+	}{
+		{
+			name:      "new member",
+			members:   []etcdMember{running},
+			want:      map[string]string{"a": "http://10.0.0.1:2380", "us": ourURL},
+			wantCount: 2,
+		},
+		{
+			name:      "already a member",
+			members:   []etcdMember{running, {ID: "b2", PeerURLs: []string{ourURL}}},
+			want:      map[string]string{"a": "http://10.0.0.1:2380", "us": ourURL},
+			wantCount: 2,
+		},
+		{
+			name:      "already a member and started",
+			members:   []etcdMember{running, {ID: "b2", Name: "us", PeerURLs: []string{ourURL}}},
+			want:      map[string]string{"a": "http://10.0.0.1:2380", "us": ourURL},
+			wantCount: 2,
+		},
+		{
+			name:      "another member not started",
+			members:   []etcdMember{running, {ID: "c3", PeerURLs: []string{"http://10.0.0.3:2380"}}},
+			want:      map[string]string{"a": "http://10.0.0.1:2380", "us": ourURL},
+			wantAdded: []string{"http://10.0.0.3:2380"},
+			wantCount: 3,
+		},
+		{
+			name:      "first peer down",
+			members:   []etcdMember{running},
+			deadFirst: true,
+			want:      map[string]string{"a": "http://10.0.0.1:2380", "us": ourURL},
+			wantCount: 2,
+		},
+		{
+			name:       "add refused",
+			members:    []etcdMember{running},
+			failStatus: http.StatusInternalServerError,
+			wantErr:    true,
+			wantCount:  1,
+		},
+	}
+	for _, tt := range tests {
+		f := &fakeMembers{members: append([]etcdMember{}, tt.members...), failStatus: tt.failStatus}
+		// peers are tried in address order, so a dead 127.0.0.1 comes before the live 127.0.0.2
+		server, port := startFakeMembers(t, "127.0.0.2", f)
+		peers := []string{"127.0.0.2"}
+		if tt.deadFirst {
+			peers = append(peers, "127.0.0.1")
+		}
+		// our own client port is not the one the peer serves on
+		cs := newTestState(&common.Config{}, &common.EtcdConfig{Name: "us", ClientAddr: "10.0.0.5", ClientPort: 1, PeerPort: 2380})
+		for _, ip := range peers {
+			cs.etcd.AddServerPeer("peer-"+ip, nil, nil, net.ParseIP(ip), 2380, port)
+		}
+		err := cs.joinCluster()
+		server.Close()
+
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: joined, want an error", tt.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+		} else {
+			if fmt.Sprint(cs.etcd.InitialCluster) != fmt.Sprint(tt.want) {
+				t.Errorf("%s: initial cluster %v, want %v", tt.name, cs.etcd.InitialCluster, tt.want)
+			}
+			if fmt.Sprint(cs.etcd.UnstartedPeers) != fmt.Sprint(append([]string{}, tt.wantAdded...)) {
+				t.Errorf("%s: unstarted members %v, want %v", tt.name, cs.etcd.UnstartedPeers, tt.wantAdded)
+			}
+			if cs.etcd.ClusterState != "existing" || cs.etcd.ClusterID != "cdf818194e3a8c32" {
+				t.Errorf("%s: cluster state '%s' id '%s'", tt.name, cs.etcd.ClusterState, cs.etcd.ClusterID)
+			}
+		}
+		if len(f.members) != tt.wantCount {
+			t.Errorf("%s: %d members after join, want %d", tt.name, len(f.members), tt.wantCount)
+		}
+	}
+}
+
+func TestMembersRemove(t *testing.T) {
+	f := &fakeMembers{members: []etcdMember{{ID: "a1", Name: "a"}, {ID: "b2", Name: "b"}}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	m := newMembersClient(server.URL+"/", server.Client())
+
+	tests := []struct {
+		id          string
+		status      int
+		wantRemoved bool
+		wantErr     bool
+	}{
+		{id: "b2", wantRemoved: true},
+		{id: "b2", wantRemoved: false}, // gone already
+		{id: "a1", status: http.StatusServiceUnavailable, wantErr: true},
+	}
+	for _, tt := range tests {
+		f.mutex.Lock()
+		f.failStatus = tt.status
+		f.mutex.Unlock()
+		removed, err := m.remove(tt.id)
+		if (err != nil) != tt.wantErr || removed != tt.wantRemoved {
+			t.Errorf("remove(%s) = %v, %v; want %v, error %v", tt.id, removed, err, tt.wantRemoved, tt.wantErr)
+		}
+	}
+	if len(f.members) != 1 || f.members[0].ID != "a1" {
+		t.Errorf("members after removal: %v", f.members)
+	}
+}
+
+func TestMembersLeaderHealth(t *testing.T) {
+	f := &fakeMembers{}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	m := newMembersClient(server.URL, server.Client())
+
+	for _, tt := range []struct {
+		leader    bool
+		unhealthy bool
+	}{{}, {leader: true}, {unhealthy: true}} {
+		f.mutex.Lock()
+		f.leader, f.unhealthy = tt.leader, tt.unhealthy
+		f.mutex.Unlock()
+		if leader, err := m.leader(); err != nil || leader != tt.leader {
+			t.Errorf("leader() = %v, %v; want %v", leader, err, tt.leader)
+		}
+		if err := m.health(); (err != nil) != tt.unhealthy {
+			t.Errorf("health() = %v; want unhealthy %v", err, tt.unhealthy)
+		}
+	}
+	if err := newMembersClient(server.URL+"/nowhere", server.Client()).health(); err == nil {
+		t.Errorf("health() of a missing endpoint succeeded")
+	}
+}
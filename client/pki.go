@@ -0,0 +1,615 @@
+package client
+
+/*
+
+Automatic PKI bootstrap
+
+With --pki, the founding node creates a cluster CA in --tls_dir and issues itself a certificate.
+Every other node generates its own key and sends a CSR to a node that holds the CA. Its private
+key never leaves the node. The CA key does: it comes back with the certificate, sealed with the
+join secret, so that every server holds the CA and answers certificate requests on --pki_port.
+With --daemon it does so for as long as it runs, so nodes that join later can reach a CA on any
+server. Without it, the founder waits after writing its conf only until the members it founded
+with have their certificates, or --pki_linger has passed. Those members must be known up front,
+so --pki without --daemon needs --expect or --handshake; a founder alone would stop its CA
+before anyone joined.
+
+The channel is plain HTTP authenticated with the join secret: a request carries
+HMAC(secret, "sign|name|ts|csr"), which proves the node knows the secret. A response carries
+HMAC(secret, "signed|cert|ca|ca_key"), which proves the CA we are about to trust is the
+cluster's. Anyone with the secret can have certificates signed, so sharing the CA key with the
+servers gives nothing away that the secret did not.
+
+*/
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 5 * 365 * 24 * time.Hour
+	// a certificate closer than this to expiry is replaced rather than reused
+	certRenewBefore = 30 * 24 * time.Hour
+)
+
+type pkiSignRequest struct {
+	Name string `json:"name"`
+	CSR  string `json:"csr"`
+	TS   int64  `json:"ts"`
+	HMAC string `json:"hmac"`
+}
+
+type pkiSignResponse struct {
+	Cert  string `json:"cert"`
+	CA    string `json:"ca"`
+	CAKey string `json:"ca_key"` // sealed with sealCAKey
+	HMAC  string `json:"hmac"`
+}
+
+func pkiMAC(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for i, p := range parts {
+		if i > 0 {
+			mac.Write([]byte("|"))
+		}
+		mac.Write([]byte(p))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// caKeyCipher is AES-GCM keyed from the join secret, for handing the CA key to servers
+func caKeyCipher(secret string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("ca key"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealCAKey(secret string, key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	aead, err := caKeyCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, der, nil)), nil
+}
+
+func openCAKey(secret string, sealed string) (*ecdsa.PrivateKey, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := caKeyCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed CA key too short")
+	}
+	der, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
+func (cs *ClientState) caKeyPath() string {
+	return filepath.Join(cs.cfg.TLSDir, "ca.key")
+}
+
+// tlsPaths points the etcd conf at the key material in --tls_dir. It is done up front so that
+// every URL we build or publish uses https.
+func (cs *ClientState) tlsPaths() {
+	if cs.etcd.CAFile == "" {
+		cs.etcd.CAFile = filepath.Join(cs.cfg.TLSDir, "ca.crt")
+	}
+	if cs.etcd.CertFile == "" {
+		cs.etcd.CertFile = filepath.Join(cs.cfg.TLSDir, "etcd.crt")
+	}
+	if cs.etcd.KeyFile == "" {
+		cs.etcd.KeyFile = filepath.Join(cs.cfg.TLSDir, "etcd.key")
+	}
+}
+
+func writePEM(path string, blockType string, der []byte, mode os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, mode); err != nil {
+		return fmt.Errorf("Could not write '%s': %s", path, err.Error())
+	}
+	return nil
+}
+
+func readPEM(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in '%s'", path)
+	}
+	return block.Bytes, nil
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// certSubject is what goes in our certificate: the etcd name plus every address we advertise
+func (cs *ClientState) certSubject() (string, []net.IP) {
+	cs.etcd.SetupAddresses()
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+	for _, a := range []string{cs.etcd.ClientAddr, cs.etcd.PeerAddr} {
+		ip, _ := common.SplitZone(a)
+		if ip == nil {
+			continue
+		}
+		seen := false
+		for _, existing := range ips {
+			seen = seen || existing.Equal(ip)
+		}
+		if !seen {
+			ips = append(ips, ip)
+		}
+	}
+	return cs.etcd.Name, ips
+}
+
+// existingCert reports whether a usable certificate from an earlier run is already in place
+func (cs *ClientState) existingCert() bool {
+	der, err := readPEM(cs.etcd.CertFile)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil || time.Now().Add(certRenewBefore).After(cert.NotAfter) {
+		return false
+	}
+	if _, err := tls.LoadX509KeyPair(cs.etcd.CertFile, cs.etcd.KeyFile); err != nil {
+		return false
+	}
+	_, err = readPEM(cs.etcd.CAFile)
+	return err == nil
+}
+
+type certAuthority struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	secret string
+	server *http.Server
+
+	mutex  sync.Mutex
+	issued map[string]bool // names we have issued certificates to
+}
+
+// loadCA reads the CA from --tls_dir. It returns nil if we do not hold the CA key.
+func (cs *ClientState) loadCA() (*certAuthority, error) {
+	keyDER, err := readPEM(cs.caKeyPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Invalid CA key '%s': %s", cs.caKeyPath(), err.Error())
+	}
+	ca := &certAuthority{secret: cs.cfg.JoinSecret}
+	certDER, err := readPEM(cs.etcd.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("CA key present but CA certificate unreadable: %s", err.Error())
+	}
+	if ca.key, err = x509.ParseECPrivateKey(keyDER); err != nil {
+		return nil, fmt.Errorf("Invalid CA key '%s': %s", cs.caKeyPath(), err.Error())
+	}
+	if ca.cert, err = x509.ParseCertificate(certDER); err != nil {
+		return nil, fmt.Errorf("Invalid CA certificate '%s': %s", cs.etcd.CAFile, err.Error())
+	}
+	fmt.Printf("Using existing cluster CA '%s'\n", cs.etcd.CAFile)
+	return ca, nil
+}
+
+// loadOrCreateCA reuses the CA in --tls_dir if there is one, so that a restarted founder keeps
+// issuing certificates the rest of the cluster trusts
+func (cs *ClientState) loadOrCreateCA() (*certAuthority, error) {
+	if ca, err := cs.loadCA(); err != nil || ca != nil {
+		return ca, err
+	}
+	ca := &certAuthority{secret: cs.cfg.JoinSecret}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: strings.TrimSpace("etcd cluster CA " + cs.cfg.ClusterName)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		return nil, err
+	}
+	ca.key = key
+	if err := writeKey(cs.caKeyPath(), key); err != nil {
+		return nil, err
+	}
+	if err := writePEM(cs.etcd.CAFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Created cluster CA '%s'\n", cs.etcd.CAFile)
+	return ca, nil
+}
+
+// sign issues a peer/client certificate for the key and addresses in a CSR
+func (ca *certAuthority) sign(csr *x509.CertificateRequest) ([]byte, error) {
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	return x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+}
+
+func (ca *certAuthority) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/sign" || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	req := &pkiSignRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	expected := pkiMAC(ca.secret, "sign", req.Name, strconv.FormatInt(req.TS, 10), req.CSR)
+	if !hmac.Equal([]byte(expected), []byte(req.HMAC)) {
+		fmt.Printf("Rejecting certificate request for '%s' from %s: bad signature\n", req.Name, r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if age := time.Since(time.Unix(req.TS, 0)); age > announcementMaxAge || age < -announcementMaxAge {
+		fmt.Printf("Rejecting certificate request for '%s' from %s: timestamp %s out\n", req.Name, r.RemoteAddr, age.String())
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil {
+		http.Error(w, "invalid csr", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		http.Error(w, "invalid csr", http.StatusBadRequest)
+		return
+	}
+	der, err := ca.sign(csr)
+	if err != nil {
+		fmt.Printf("Error signing certificate for '%s': %s\n", req.Name, err.Error())
+		http.Error(w, "signing failed", http.StatusInternalServerError)
+		return
+	}
+
+	sealed, err := sealCAKey(ca.secret, ca.key)
+	if err != nil {
+		fmt.Printf("Error sealing CA key for '%s': %s\n", req.Name, err.Error())
+		http.Error(w, "signing failed", http.StatusInternalServerError)
+		return
+	}
+
+	resp := &pkiSignResponse{
+		Cert:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		CA:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})),
+		CAKey: sealed,
+	}
+	resp.HMAC = pkiMAC(ca.secret, "signed", resp.Cert, resp.CA, resp.CAKey)
+	ca.mutex.Lock()
+	ca.issued[req.Name] = true
+	ca.mutex.Unlock()
+	fmt.Printf("Issued certificate for '%s' (%v) to %s\n", req.Name, csr.IPAddresses, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// issueOwn signs our own certificate directly with the CA
+func (cs *ClientState) issueOwn(ca *certAuthority) error {
+	key, csrPEM, err := cs.newCSR()
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(csrPEM)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return err
+	}
+	der, err := ca.sign(csr)
+	if err != nil {
+		return err
+	}
+	if err := writeKey(cs.etcd.KeyFile, key); err != nil {
+		return err
+	}
+	return writePEM(cs.etcd.CertFile, "CERTIFICATE", der, 0644)
+}
+
+func (cs *ClientState) newCSR() (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, ips := cs.certSubject()
+	template := &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{name, "localhost"},
+		IPAddresses: ips,
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// requestCert sends a CSR to the CA at addr and installs the certificate it returns
+func (cs *ClientState) requestCert(addr string, key *ecdsa.PrivateKey, csrPEM []byte) error {
+	req := &pkiSignRequest{Name: cs.etcd.Name, CSR: string(csrPEM), TS: time.Now().Unix()}
+	req.HMAC = pkiMAC(cs.cfg.JoinSecret, "sign", req.Name, strconv.FormatInt(req.TS, 10), req.CSR)
+	body, _ := json.Marshal(req)
+
+	resp, err := cs.prober.lan().Post(fmt.Sprintf("http://%s/sign", addr), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CA at %s returned %s", addr, resp.Status)
+	}
+	signed := &pkiSignResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(signed); err != nil {
+		return fmt.Errorf("Invalid response from CA at %s: %s", addr, err.Error())
+	}
+	if !hmac.Equal([]byte(signed.HMAC), []byte(pkiMAC(cs.cfg.JoinSecret, "signed", signed.Cert, signed.CA, signed.CAKey))) {
+		return fmt.Errorf("Response from CA at %s is not signed with the join secret", addr)
+	}
+	caKey, err := openCAKey(cs.cfg.JoinSecret, signed.CAKey)
+	if err != nil {
+		return fmt.Errorf("Could not open the CA key from %s: %s", addr, err.Error())
+	}
+
+	if err := writeKey(cs.etcd.KeyFile, key); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cs.etcd.CertFile, []byte(signed.Cert), 0644); err != nil {
+		return fmt.Errorf("Could not write '%s': %s", cs.etcd.CertFile, err.Error())
+	}
+	if err := ioutil.WriteFile(cs.etcd.CAFile, []byte(signed.CA), 0644); err != nil {
+		return fmt.Errorf("Could not write '%s': %s", cs.etcd.CAFile, err.Error())
+	}
+	if err := writeKey(cs.caKeyPath(), caKey); err != nil {
+		return err
+	}
+	fmt.Printf("Installed certificate from CA at %s in '%s'\n", addr, cs.cfg.TLSDir)
+	return nil
+}
+
+// caAddrs lists where the CA might be: the agreed founder, then every running server
+func (cs *ClientState) caAddrs() []string {
+	port := strconv.Itoa(cs.cfg.PKIPort)
+	addrs := make([]string, 0)
+	if cs.etcd.Founder != "" && cs.etcd.Founder != cs.etcd.Name {
+		if u, err := url.Parse(cs.etcd.InitialCluster[cs.etcd.Founder]); err == nil && u.Host != "" {
+			host, _, err := net.SplitHostPort(u.Host)
+			if err != nil {
+				host = u.Host
+			}
+			addrs = append(addrs, net.JoinHostPort(host, port))
+		}
+	}
+	keys := make([]string, 0, len(cs.etcd.ServerPeers))
+	for k, _ := range cs.etcd.ServerPeers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := cs.etcd.ServerPeers[k]
+		addrs = append(addrs, common.URLHost(p.PeerIP, p.Zone(), cs.cfg.PKIPort))
+	}
+	return addrs
+}
+
+// isFounder: we agreed to found, or found alone with nobody running
+func (cs *ClientState) isFounder() bool {
+	if len(cs.etcd.ServerPeers) > 0 {
+		return false
+	}
+	return cs.etcd.Founder == "" || cs.etcd.Founder == cs.etcd.Name
+}
+
+// serveCA answers certificate requests on --pki_port until lingerPKI stops it
+func (cs *ClientState) serveCA(ca *certAuthority) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cs.cfg.PKIPort))
+	if err != nil {
+		return fmt.Errorf("Could not listen for certificate requests on port %d: %s", cs.cfg.PKIPort, err.Error())
+	}
+	ca.issued = make(map[string]bool)
+	ca.server = &http.Server{Handler: ca}
+	go ca.server.Serve(listener)
+	cs.ca = ca
+	fmt.Printf("Serving certificate requests on port %d\n", cs.cfg.PKIPort)
+	return nil
+}
+
+// checkPKIOptions rejects --pki where nobody could get a certificate from the founder
+func checkPKIOptions(cfg *common.Config) error {
+	if !cfg.PKI {
+		return nil
+	}
+	if cfg.JoinSecret == "" {
+		return fmt.Errorf("--pki requires --join_secret")
+	}
+	if cfg.Expect == 0 && !cfg.Handshake && !cfg.Daemon {
+		return fmt.Errorf("--pki requires --daemon, --expect or --handshake, so that the CA is up for every joiner")
+	}
+	return nil
+}
+
+// setupPKI puts a CA-signed certificate in place before the conf is written, and serves the CA
+// if we hold its key
+func (cs *ClientState) setupPKI() error {
+	if err := os.MkdirAll(cs.cfg.TLSDir, 0700); err != nil {
+		return fmt.Errorf("Could not create TLS directory '%s': %s", cs.cfg.TLSDir, err.Error())
+	}
+
+	if cs.isFounder() {
+		ca, err := cs.loadOrCreateCA()
+		if err != nil {
+			return err
+		}
+		if err := cs.issueOwn(ca); err != nil {
+			return fmt.Errorf("Could not issue our own certificate: %s", err.Error())
+		}
+		return cs.serveCA(ca)
+	}
+
+	if cs.existingCert() {
+		fmt.Printf("Using existing certificate '%s'\n", cs.etcd.CertFile)
+	} else if err := cs.fetchCert(); err != nil {
+		return err
+	}
+	ca, err := cs.loadCA()
+	if err != nil || ca == nil {
+		return err
+	}
+	return cs.serveCA(ca)
+}
+
+// fetchCert has our CSR signed by the first CA that answers
+func (cs *ClientState) fetchCert() error {
+	addrs := cs.caAddrs()
+	if len(addrs) == 0 {
+		return fmt.Errorf("No founder or server peer to request a certificate from")
+	}
+	key, csrPEM, err := cs.newCSR()
+	if err != nil {
+		return err
+	}
+	// the founder may still be creating its CA
+	deadline := time.Now().Add(cs.cfg.PKILinger)
+	for {
+		for _, addr := range addrs {
+			if err := cs.requestCert(addr, key, csrPEM); err != nil {
+				fmt.Printf("Certificate request to %s failed: %s\n", addr, err.Error())
+			} else {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Could not obtain a certificate from any of %v", addrs)
+		}
+		time.Sleep(cs.cfg.PollInterval)
+	}
+}
+
+// pending lists the members other than self we have not issued certificates to
+func (ca *certAuthority) pending(members map[string]string, self string) []string {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	names := make([]string, 0)
+	for name, _ := range members {
+		if name != self && !ca.issued[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lingerPKI stops the CA once our conf is written, without --daemon. The founder first waits
+// until the members it founded with have their certificates, or --pki_linger has passed.
+func (cs *ClientState) lingerPKI() {
+	if cs.ca == nil {
+		return
+	}
+	defer cs.ca.server.Close()
+	if !cs.isFounder() {
+		return
+	}
+	deadline := time.Now().Add(cs.cfg.PKILinger)
+	waiting := cs.ca.pending(cs.etcd.InitialCluster, cs.etcd.Name)
+	if len(waiting) > 0 {
+		fmt.Printf("Waiting up to %s for %v to request certificates\n", cs.cfg.PKILinger.String(), waiting)
+	}
+	for len(waiting) > 0 {
+		if time.Now().After(deadline) {
+			fmt.Printf("Gave up waiting for %v to request certificates\n", waiting)
+			return
+		}
+		time.Sleep(cs.cfg.PollInterval)
+		waiting = cs.ca.pending(cs.etcd.InitialCluster, cs.etcd.Name)
+	}
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+func newPKITestState(t *testing.T, name string, secret string) *ClientState {
+	dir, err := ioutil.TempDir("", "pki-"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &common.Config{PKI: true, Expect: 2, JoinSecret: secret, TLSDir: dir, PKILinger: 5 * time.Second, PollInterval: 10 * time.Millisecond, ProbeTimeout: 2 * time.Second}
+	etcd := &common.EtcdConfig{
+		Name:           name,
+		ClientAddr:     "127.0.0.1",
+		PeerAddr:       "127.0.0.1",
+		InitialCluster: map[string]string{"a": "https://10.0.0.1:2380", "b": "https://10.0.0.2:2380"},
+	}
+	cs := newTestState(cfg, etcd)
+	cs.tlsPaths()
+	return cs
+}
+
+// startTestCA has founder create its CA and serves it the way serveCA would
+func startTestCA(t *testing.T, founder *ClientState) *httptest.Server {
+	ca, err := founder.loadOrCreateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := founder.issueOwn(ca); err != nil {
+		t.Fatal(err)
+	}
+	ca.issued = make(map[string]bool)
+	server := httptest.NewServer(ca)
+	ca.server = server.Config
+	founder.ca = ca
+	return server
+}
+
+func TestPKIShareCA(t *testing.T) {
+	founder := newPKITestState(t, "a", testSecret)
+	defer os.RemoveAll(founder.cfg.TLSDir)
+	server := startTestCA(t, founder)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	if waiting := founder.ca.pending(founder.etcd.InitialCluster, "a"); len(waiting) != 1 || waiting[0] != "b" {
+		t.Errorf("founder waiting for %v before anyone asked, want [b]", waiting)
+	}
+
+	outsider := newPKITestState(t, "b", "guess")
+	defer os.RemoveAll(outsider.cfg.TLSDir)
+	key, csrPEM, _ := outsider.newCSR()
+	if err := outsider.requestCert(addr, key, csrPEM); err == nil {
+		t.Errorf("CA signed a request made with the wrong secret")
+	}
+
+	member := newPKITestState(t, "b", testSecret)
+	defer os.RemoveAll(member.cfg.TLSDir)
+	key, csrPEM, _ = member.newCSR()
+	if err := member.requestCert(addr, key, csrPEM); err != nil {
+		t.Fatalf("certificate request: %s", err.Error())
+	}
+	if !member.existingCert() {
+		t.Errorf("member has no usable certificate after its request")
+	}
+	// the member now holds the CA, so it can answer requests once the founder is gone
+	ca, err := member.loadCA()
+	if err != nil || ca == nil {
+		t.Fatalf("member does not hold the CA key: %v", err)
+	}
+	if !ca.key.PublicKey.Equal(&founder.ca.key.PublicKey) || !ca.cert.Equal(founder.ca.cert) {
+		t.Errorf("member holds a different CA from the founder's")
+	}
+
+	if waiting := founder.ca.pending(founder.etcd.InitialCluster, "a"); len(waiting) != 0 {
+		t.Errorf("founder still waiting for %v", waiting)
+	}
+	start := time.Now()
+	founder.lingerPKI()
+	if time.Since(start) > time.Second {
+		t.Errorf("founder lingered %s with every member served", time.Since(start).String())
+	}
+}
+
+// a member the founder founded with fetches its certificate from the founder, then a node joining
+// the running cluster later fetches one from a server
+func TestPKIFetchCert(t *testing.T) {
+	founder := newPKITestState(t, "a", testSecret)
+	defer os.RemoveAll(founder.cfg.TLSDir)
+	founder.etcd.Founder = "a"
+	server := startTestCA(t, founder)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	pkiPort, _ := strconv.Atoi(port)
+
+	member := newPKITestState(t, "b", testSecret)
+	defer os.RemoveAll(member.cfg.TLSDir)
+	member.cfg.PKIPort = pkiPort
+	member.etcd.Founder = "a"
+	member.etcd.InitialCluster["a"] = "https://127.0.0.1:2380"
+	if err := member.fetchCert(); err != nil {
+		t.Fatalf("founding member: %s", err.Error())
+	}
+	if !member.existingCert() {
+		t.Errorf("founding member has no usable certificate")
+	}
+
+	joiner := newPKITestState(t, "c", testSecret)
+	defer os.RemoveAll(joiner.cfg.TLSDir)
+	joiner.cfg.PKIPort = pkiPort
+	joiner.etcd.InitialCluster = make(map[string]string)
+	joiner.etcd.AddServerPeer("a", nil, net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.1"), 2380, 2379)
+	if joiner.isFounder() {
+		t.Errorf("joiner of a running cluster thinks it founds")
+	}
+	if err := joiner.fetchCert(); err != nil {
+		t.Fatalf("joiner: %s", err.Error())
+	}
+	if !joiner.existingCert() {
+		t.Errorf("joiner has no usable certificate")
+	}
+	if waiting := founder.ca.pending(founder.etcd.InitialCluster, "a"); len(waiting) != 0 {
+		t.Errorf("founder still waiting for %v", waiting)
+	}
+}
+
+func TestCheckPKIOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     common.Config
+		wantErr bool
+	}{
+		{name: "off", cfg: common.Config{}},
+		{name: "expect", cfg: common.Config{PKI: true, JoinSecret: testSecret, Expect: 3}},
+		{name: "handshake", cfg: common.Config{PKI: true, JoinSecret: testSecret, Handshake: true}},
+		{name: "daemon", cfg: common.Config{PKI: true, JoinSecret: testSecret, Daemon: true}},
+		{name: "no secret", cfg: common.Config{PKI: true, Expect: 3}, wantErr: true},
+		{name: "founder alone", cfg: common.Config{PKI: true, JoinSecret: testSecret}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkPKIOptions(&tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkPKIOptions returned %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"fmt"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"net"
+	"strconv"
+)
+
+// peerCandidate is a checked browse result, with what the peer told us about itself in TXT
+type peerCandidate struct {
+	ent        *AvahiBrowseResult
+	name       string
+	iface      *net.Interface
+	localIP    net.IP // nil until the return path is checked, for peers beyond a router
+	peerIP     net.IP
+	peerPort   int
+	clientPort int
+	echoPort   int
+	advertised net.IP // our address as peers will be given it, as it stood when queued; may be nil
+	priority   int
+	role       string
+	url        string // etcd client URL to probe
+	pathOnly   bool   // only the return path is wanted, not the etcd probe
+}
+
+func (cs *ClientState) newPeerCandidate(ent *AvahiBrowseResult, iface *net.Interface, localIP net.IP, peerIP net.IP) *peerCandidate {
+	c := &peerCandidate{
+		ent:        ent,
+		name:       cs.peerMDNSHostname(ent),
+		iface:      iface,
+		localIP:    localIP,
+		peerIP:     peerIP,
+		peerPort:   ent.Port,
+		clientPort: cs.etcd.ClientPort,
+		echoPort:   cs.cfg.EchoPort,
+		advertised: cs.advertisedIP(),
+	}
+	if v, ok := txtValue(ent.TXT, "priority"); ok {
+		c.priority, _ = strconv.Atoi(v)
+	}
+	if v, ok := txtValue(ent.TXT, "client_port"); ok {
+		if p, err := strconv.Atoi(v); err == nil {
+			c.clientPort = p
+		}
+	}
+	if v, ok := txtValue(ent.TXT, "echo_port"); ok {
+		if p, err := strconv.Atoi(v); err == nil {
+			c.echoPort = p
+		}
+	}
+	c.role, _ = txtValue(ent.TXT, "role")
+	c.url = fmt.Sprintf("%s://%s/v2/keys/", cs.etcd.Scheme(), common.URLHost(peerIP, ent.InterfaceName, c.clientPort))
+	return c
+}
+
+func (c *peerCandidate) member() clusterMember {
+	return clusterMember{name: c.name, peerIP: c.peerIP, zone: c.ent.InterfaceName, peerPort: c.peerPort, priority: c.priority}
+}
+
+// probeEvent is the outcome of probing one candidate, sent back to stateTask
+type probeEvent interface {
+	candidate() *peerCandidate
+}
+
+// serverFoundEvent: etcd answered on the candidate's client port
+type serverFoundEvent struct {
+	c *peerCandidate
+}
+
+// peerBootingEvent: the candidate is one of us, but not serving yet
+type peerBootingEvent struct {
+	c      *peerCandidate
+	reason error
+}
+
+// proxyIgnoredEvent: the candidate is an etcd proxy, which is never a cluster member
+type proxyIgnoredEvent struct {
+	c *peerCandidate
+}
+
+// peerRejectedEvent: the candidate is beyond a router and its return path did not check out
+type peerRejectedEvent struct {
+	c      *peerCandidate
+	reason error
+}
+
+// pathCheckedEvent: the candidate's return path checked out, which is all a pathOnly probe asks
+type pathCheckedEvent struct {
+	c *peerCandidate
+}
+
+func (e *serverFoundEvent) candidate() *peerCandidate  { return e.c }
+func (e *peerBootingEvent) candidate() *peerCandidate  { return e.c }
+func (e *proxyIgnoredEvent) candidate() *peerCandidate { return e.c }
+func (e *peerRejectedEvent) candidate() *peerCandidate { return e.c }
+func (e *pathCheckedEvent) candidate() *peerCandidate  { return e.c }
+
+// probePool probes candidates on a fixed number of workers, so that slow or hung peers never
+// hold up the state machine. Every probe is bounded by the prober's timeout.
+type probePool struct {
+	prober  *prober
+	queue   chan *peerCandidate
+	results chan probeEvent
+	done    chan bool
+}
+
+func newProbePool(p *prober, workers int) *probePool {
+	if workers < 1 {
+		workers = 1
+	}
+	pool := &probePool{
+		prober:  p,
+		queue:   make(chan *peerCandidate, workers*16),
+		results: make(chan probeEvent, workers*16),
+		done:    make(chan bool),
+	}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// submit queues a candidate without blocking; false means the queue is full
+func (pool *probePool) submit(c *peerCandidate) bool {
+	select {
+	case pool.queue <- c:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pool *probePool) work() {
+	for {
+		select {
+		case c := <-pool.queue:
+			ev := pool.probe(c)
+			select {
+			case pool.results <- ev:
+			case <-pool.done:
+				return
+			}
+		case <-pool.done:
+			return
+		}
+	}
+}
+
+func (pool *probePool) probe(c *peerCandidate) probeEvent {
+	if c.localIP == nil {
+		if err := pool.prober.checkReturnPath(c); err != nil {
+			return &peerRejectedEvent{c: c, reason: err}
+		}
+	}
+	if c.pathOnly {
+		return &pathCheckedEvent{c: c}
+	}
+	switch c.role {
+	case roleProxy:
+		return &proxyIgnoredEvent{c: c}
+	case roleBooting:
+		// no need to probe; it has told us it is not serving yet
+		return &peerBootingEvent{c: c, reason: fmt.Errorf("peer reports role '%s'", c.role)}
+	}
+	if err := pool.prober.alive(c.url); err != nil {
+		return &peerBootingEvent{c: c, reason: err}
+	}
+	return &serverFoundEvent{c: c}
+}
+
+func (pool *probePool) stop() {
+	close(pool.done)
+}
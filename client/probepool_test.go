@@ -0,0 +1,65 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+func TestProbePool(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, deadPort, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	cs := newTestState(&common.Config{ProbeTimeout: 2 * time.Second}, &common.EtcdConfig{ClientPort: 1})
+	pool := newProbePool(cs.prober, 2)
+	defer pool.stop()
+
+	tests := []struct {
+		name string
+		txt  []string
+		want string
+	}{
+		{name: "server", txt: []string{"role=server", "client_port=" + port}, want: "*client.serverFoundEvent"},
+		{name: "no role", txt: []string{"client_port=" + port}, want: "*client.serverFoundEvent"},
+		{name: "booting", txt: []string{"role=booting", "client_port=" + port}, want: "*client.peerBootingEvent"},
+		{name: "not serving", txt: []string{"role=server", "client_port=" + deadPort}, want: "*client.peerBootingEvent"},
+		{name: "proxy", txt: []string{"role=proxy", "client_port=" + port}, want: "*client.proxyIgnoredEvent"},
+	}
+	want := make(map[string]string)
+	for _, tt := range tests {
+		ent := &AvahiBrowseResult{Name: tt.name, Port: 2380, TXT: tt.txt}
+		c := cs.newPeerCandidate(ent, nil, net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.1"))
+		if !pool.submit(c) {
+			t.Fatalf("%s: queue full", tt.name)
+		}
+		want[c.name] = tt.want
+	}
+	for range tests {
+		select {
+		case ev := <-pool.results:
+			c := ev.candidate()
+			if got := fmt.Sprintf("%T", ev); got != want[c.name] {
+				t.Errorf("%s: %s, want %s", c.name, got, want[c.name])
+			}
+			if p, _ := strconv.Atoi(port); c.name == "server" && (c.clientPort != p || c.peerPort != 2380) {
+				t.Errorf("%s: client port %d peer port %d, want those it published", c.name, c.clientPort, c.peerPort)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("probes did not finish")
+		}
+	}
+}
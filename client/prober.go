@@ -0,0 +1,165 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// prober builds the HTTP clients used for everything we fetch. Every request has a timeout so
+// that a hung peer cannot stall discovery. Proxy settings from the environment apply to the
+// discovery URL, which is usually on the internet, but never to peers on the LAN. Clients are
+// kept and reused, so that their idle connections are too, until the TLS files change.
+type prober struct {
+	cfg  *common.Config
+	etcd *common.EtcdConfig
+
+	mutex   sync.Mutex
+	clients map[string]*probeClient
+}
+
+type probeClient struct {
+	stamp  [sha256.Size]byte // of the TLS files it was built from
+	client *http.Client
+}
+
+func newProber(cfg *common.Config, etcd *common.EtcdConfig) *prober {
+	return &prober{cfg: cfg, etcd: etcd, clients: make(map[string]*probeClient)}
+}
+
+// tlsFiles are the --probe_* files, falling back to etcd's own (which --pki fills in)
+func (p *prober) tlsFiles() (string, string, string) {
+	caFile, certFile, keyFile := p.cfg.ProbeCAFile, p.cfg.ProbeCertFile, p.cfg.ProbeKeyFile
+	if caFile == "" {
+		caFile = p.etcd.CAFile
+	}
+	if certFile == "" {
+		certFile, keyFile = p.etcd.CertFile, p.etcd.KeyFile
+	}
+	return caFile, certFile, keyFile
+}
+
+// tlsConfig trusts caFile if it can be read, and presents the client certificate if there is one.
+// The files are re-read every time since --pki writes them part way through a run.
+func tlsConfig(caFile string, certFile string, keyFile string) (*tls.Config, bool) {
+	config := &tls.Config{}
+	trusted := false
+	if caFile != "" {
+		if caPEM, err := ioutil.ReadFile(caFile); err == nil {
+			pool := x509.NewCertPool()
+			if pool.AppendCertsFromPEM(caPEM) {
+				config.RootCAs = pool
+				trusted = true
+			}
+		}
+	}
+	if certFile != "" {
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			config.Certificates = []tls.Certificate{cert}
+		}
+	}
+	return config, trusted
+}
+
+// tlsStamp changes whenever the content of one of the files does
+func tlsStamp(files ...string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, f := range files {
+		h.Write([]byte(f + "\x00"))
+		if f != "" {
+			data, _ := ioutil.ReadFile(f)
+			h.Write(data)
+		}
+		h.Write([]byte{0})
+	}
+	var stamp [sha256.Size]byte
+	copy(stamp[:], h.Sum(nil))
+	return stamp
+}
+
+// cached returns the client for kind, built by build from files. It is rebuilt only once the
+// files change, as when --pki writes them, and the old client's idle connections are closed.
+func (p *prober) cached(kind string, files []string, build func() *http.Client) *http.Client {
+	stamp := tlsStamp(files...)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if c, ok := p.clients[kind]; ok {
+		if c.stamp == stamp {
+			return c.client
+		}
+		c.client.CloseIdleConnections()
+	}
+	client := build()
+	p.clients[kind] = &probeClient{stamp: stamp, client: client}
+	return client
+}
+
+func (p *prober) client(proxy func(*http.Request) (*url.URL, error), config *tls.Config) *http.Client {
+	dialer := &net.Dialer{Timeout: p.cfg.ProbeTimeout}
+	return &http.Client{
+		Timeout: p.cfg.ProbeTimeout,
+		Transport: &http.Transport{
+			Proxy:               proxy,
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     config,
+			TLSHandshakeTimeout: p.cfg.ProbeTimeout,
+		},
+	}
+}
+
+// lan is for etcd and our own services on peers, verified against the cluster CA
+func (p *prober) lan() *http.Client {
+	caFile, certFile, keyFile := p.tlsFiles()
+	return p.cached("lan", []string{caFile, certFile, keyFile}, func() *http.Client {
+		config, _ := tlsConfig(caFile, certFile, keyFile)
+		return p.client(nil, config)
+	})
+}
+
+// discovery is for the discovery URL. Only an explicit --probe_ca_file replaces the system
+// roots, since the cluster CA will not have signed a public discovery service.
+func (p *prober) discovery() *http.Client {
+	_, certFile, keyFile := p.tlsFiles()
+	return p.cached("discovery", []string{p.cfg.ProbeCAFile, certFile, keyFile}, func() *http.Client {
+		config, _ := tlsConfig(p.cfg.ProbeCAFile, certFile, keyFile)
+		return p.client(http.ProxyFromEnvironment, config)
+	})
+}
+
+// alive checks for a running etcd at url. Over TLS we may not have the CA or a certificate yet,
+// so without a CA this is only a liveness check, and a server that rejects us during the
+// handshake is still up.
+func (p *prober) alive(u string) error {
+	client := p.lan()
+	if strings.HasPrefix(u, "https:") {
+		caFile, certFile, keyFile := p.tlsFiles()
+		client = p.cached("alive", []string{caFile, certFile, keyFile}, func() *http.Client {
+			config, trusted := tlsConfig(caFile, certFile, keyFile)
+			config.InsecureSkipVerify = !trusted
+			return p.client(nil, config)
+		})
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		if rejectedByPeer(err) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// rejectedByPeer: the peer sent a TLS alert, so it is up and speaking TLS but will not have us
+func rejectedByPeer(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+func newProberTestState(caFile string) *prober {
+	return newTestState(&common.Config{ProbeTimeout: 2 * time.Second}, &common.EtcdConfig{CAFile: caFile}).prober
+}
+
+func TestProberAlive(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	plain := httptest.NewServer(ok)
+	defer plain.Close()
+	// a peer that wants a client certificate we do not have yet
+	strict := httptest.NewUnstartedServer(ok)
+	strict.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+	strict.StartTLS()
+	defer strict.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := "http://" + l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{name: "plain", url: plain.URL},
+		{name: "rejects us", url: strict.URL},
+		{name: "dead", url: dead, wantErr: true},
+	}
+	p := newProberTestState("")
+	for _, tt := range tests {
+		err := p.alive(tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: alive returned %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestProberReuse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prober")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	p := newProberTestState(caFile)
+
+	first := p.lan()
+	if p.lan() != first {
+		t.Errorf("lan built a new client with the TLS files unchanged")
+	}
+	// --pki writes the CA part way through a run
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	second := p.lan()
+	if second == first {
+		t.Errorf("lan kept its client after the CA was written")
+	}
+	resp, err := second.Get(server.URL)
+	if err != nil {
+		t.Fatalf("client built from the new CA: %s", err.Error())
+	}
+	resp.Body.Close()
+	if p.lan() != second {
+		t.Errorf("lan built a new client with the TLS files unchanged")
+	}
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// With --reap, the daemon removes etcd members that have been gone for --reap_grace: not seen
+// by discovery, and not healthy on any of their client URLs. Members are listed through our own
+// etcd, so a node cut off from the cluster never reaps anyone. Every daemon keeps track of who
+// is gone, so a new leader carries on where the old one stopped, but only the leader removes,
+// and only while a quorum of the members report themselves healthy to etcd; being seen by
+// discovery keeps a member from being reaped but does not count towards that quorum. One member
+// goes per check. With --reap_dry_run we only say what we would remove.
+
+// the members API is asked at most this often, however fast we poll
+const reapCheckInterval = 10 * time.Second
+
+type reaper struct {
+	cs          *ClientState
+	absentSince map[string]time.Time // by member ID
+	present     chan map[string]bool // names of the peers in the peer table
+	reaped      chan string          // names of members removed, for the watch loop
+}
+
+func newReaper(cs *ClientState) *reaper {
+	return &reaper{
+		cs:          cs,
+		absentSince: make(map[string]time.Time),
+		present:     make(chan map[string]bool, 1),
+		reaped:      make(chan string, 16),
+	}
+}
+
+// observe hands over the current peer names without blocking the watch loop
+func (r *reaper) observe(present map[string]bool) {
+	select {
+	case r.present <- present:
+	default:
+	}
+}
+
+func (r *reaper) run() {
+	lastCheck := time.Time{}
+	for present := range r.present {
+		if time.Since(lastCheck) < reapCheckInterval {
+			continue
+		}
+		lastCheck = time.Now()
+		r.check(present, lastCheck)
+	}
+}
+
+// healthy: etcd on one of the member's client URLs says it is healthy
+func (r *reaper) healthy(member etcdMember) bool {
+	for _, u := range member.ClientURLs {
+		if newMembersClient(u, r.cs.prober.lan()).health() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *reaper) check(present map[string]bool, now time.Time) {
+	m := newMembersClient(r.cs.etcd.ClientURL(), r.cs.prober.lan())
+	members, _, err := m.list()
+	if err != nil {
+		fmt.Printf("Reaper: could not list members through our own etcd: %s\n", err.Error())
+		return
+	}
+
+	healthy := 0
+	overdue := make([]etcdMember, 0)
+	current := make(map[string]bool)
+	for _, member := range members {
+		current[member.ID] = true
+		if member.Name == "" {
+			// added but not started; it may be joining right now, and it has a vote but no health
+			continue
+		}
+		up := r.healthy(member)
+		if up {
+			healthy++
+		}
+		if up || present[member.Name] || member.Name == r.cs.etcd.Name {
+			if _, ok := r.absentSince[member.ID]; ok {
+				fmt.Printf("Reaper: member '%s' is back\n", member.Name)
+				delete(r.absentSince, member.ID)
+			}
+			continue
+		}
+		since, ok := r.absentSince[member.ID]
+		if !ok {
+			fmt.Printf("Reaper: member '%s' (%s) is absent and not healthy\n", member.Name, strings.Join(member.PeerURLs, ","))
+			r.absentSince[member.ID] = now
+		} else if now.Sub(since) > r.cs.cfg.ReapGrace {
+			overdue = append(overdue, member)
+		}
+	}
+	for id, _ := range r.absentSince {
+		if !current[id] {
+			// removed by someone else
+			delete(r.absentSince, id)
+		}
+	}
+	if len(overdue) == 0 {
+		return
+	}
+
+	leader, err := m.leader()
+	if err != nil {
+		fmt.Printf("Reaper: could not ask our own etcd whether it leads: %s\n", err.Error())
+		return
+	}
+	if !leader {
+		return
+	}
+	quorum := len(members)/2 + 1
+	if healthy < quorum {
+		fmt.Printf("Reaper: only %d of %d members healthy, below quorum of %d; not removing anyone\n", healthy, len(members), quorum)
+		return
+	}
+	member := overdue[0]
+	absent := now.Sub(r.absentSince[member.ID])
+	if r.cs.cfg.ReapDryRun {
+		fmt.Printf("Reaper: would remove member '%s' (%s), absent for %s (dry run)\n", member.Name, member.ID, absent.String())
+		return
+	}
+	removed, err := m.remove(member.ID)
+	if err != nil {
+		fmt.Printf("Reaper: could not remove member '%s': %s\n", member.Name, err.Error())
+		return
+	}
+	if removed {
+		fmt.Printf("Reaper: removed member '%s' (%s), absent for %s\n", member.Name, member.ID, absent.String())
+	}
+	delete(r.absentSince, member.ID)
+	r.reaped <- member.Name
+}
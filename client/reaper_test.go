@@ -0,0 +1,90 @@
+package client
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+// deadURL is a client URL nothing listens on
+func deadURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return "http://" + l.Addr().String()
+}
+
+func TestReaper(t *testing.T) {
+	healthyB := httptest.NewServer(&fakeMembers{})
+	defer healthyB.Close()
+	unhealthyB := httptest.NewServer(&fakeMembers{unhealthy: true})
+	defer unhealthyB.Close()
+	dead := deadURL(t)
+	const grace = time.Minute
+
+	tests := []struct {
+		name       string
+		bURL       string
+		present    map[string]bool
+		notStarted bool // a fourth member has been added but not started
+		follower   bool
+		dryRun     bool
+		want       string // the member removed
+	}{
+		{name: "gone", bURL: healthyB.URL, want: "c"},
+		{name: "seen by discovery", bURL: healthyB.URL, present: map[string]bool{"c": true}},
+		{name: "follower", bURL: healthyB.URL, follower: true},
+		{name: "dry run", bURL: healthyB.URL, dryRun: true},
+		// b is up and seen, but etcd there is not healthy, so only we are
+		{name: "below quorum", bURL: unhealthyB.URL, present: map[string]bool{"b": true}},
+		{name: "dead member seen", bURL: dead, present: map[string]bool{"b": true}},
+		// the unstarted member votes, so two healthy of four is not a quorum
+		{name: "member not started", bURL: healthyB.URL, notStarted: true},
+	}
+	for _, tt := range tests {
+		f := &fakeMembers{leader: !tt.follower}
+		ours := httptest.NewServer(f)
+		f.members = []etcdMember{
+			{ID: "a1", Name: "us", ClientURLs: []string{ours.URL}},
+			{ID: "b2", Name: "b", ClientURLs: []string{tt.bURL}},
+			{ID: "c3", Name: "c", PeerURLs: []string{"http://10.0.0.3:2380"}, ClientURLs: []string{dead}},
+		}
+		if tt.notStarted {
+			f.members = append(f.members, etcdMember{ID: "d4"})
+		}
+		cfg := &common.Config{ProbeTimeout: time.Second, ReapGrace: grace, ReapDryRun: tt.dryRun}
+		etcd := &common.EtcdConfig{Name: "us", ClientAddr: "127.0.0.1", ClientPort: ours.Listener.Addr().(*net.TCPAddr).Port}
+		r := newReaper(newTestState(cfg, etcd))
+
+		start := time.Now()
+		r.check(tt.present, start)
+		if _, ok := r.absentSince["c3"]; ok == tt.present["c"] {
+			t.Errorf("%s: c absent %v after the first check", tt.name, ok)
+		}
+		r.check(tt.present, start.Add(grace/2))
+		r.check(tt.present, start.Add(grace+time.Second))
+		ours.Close()
+
+		got := ""
+		select {
+		case got = <-r.reaped:
+		default:
+		}
+		if got != tt.want {
+			t.Errorf("%s: reaped '%s', want '%s'", tt.name, got, tt.want)
+		}
+		for _, m := range f.members {
+			if tt.want != "" && m.Name == tt.want {
+				t.Errorf("%s: '%s' is still a member", tt.name, m.Name)
+			}
+		}
+		if _, ok := r.absentSince["c3"]; ok && tt.want != "" {
+			t.Errorf("%s: still tracking the removed member", tt.name)
+		}
+	}
+}
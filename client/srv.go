@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const srvLookupTimeout = 5 * time.Second
+
+// srvResolver is the part of *net.Resolver we use, so that tests can stand in for DNS
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// srvDiscoverer finds peers through DNS SRV records, for networks that run internal DNS
+type srvDiscoverer struct {
+	lookup srvResolver // nil uses --srv_resolver or the system resolver
+}
+
+func (d *srvDiscoverer) Name() string {
+	return "srv"
+}
+
+func (d *srvDiscoverer) resolver(cs *ClientState) srvResolver {
+	if d.lookup != nil {
+		return d.lookup
+	}
+	if cs.cfg.SRVResolver == "" {
+		return net.DefaultResolver
+	}
+	server := cs.cfg.SRVResolver
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func (d *srvDiscoverer) Poll(cs *ClientState) bool {
+	if cs.cfg.SRVDomain == "" {
+		fmt.Printf("SRV discovery: no domain given (--srv_domain); skipping\n")
+		return false
+	}
+	name := fmt.Sprintf("%s.%s", strings.Trim(cs.cfg.SRVName, "."), strings.Trim(cs.cfg.SRVDomain, "."))
+	resolver := d.resolver(cs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		fmt.Printf("SRV discovery: Error looking up '%s': %s\n", name, err.Error())
+		return false
+	}
+	for _, srv := range orderSRV(records) {
+		target := strings.TrimSuffix(srv.Target, ".")
+		addrs, err := resolver.LookupIPAddr(ctx, target)
+		if err != nil {
+			fmt.Printf("SRV discovery: Error resolving target '%s': %s\n", target, err.Error())
+			continue
+		}
+		a := &AvahiBrowseResult{
+			Type:       "=",
+			Protocol:   "IPv4",
+			Name:       target,
+			Service:    strings.Trim(cs.cfg.SRVName, "."),
+			Domain:     strings.Trim(cs.cfg.SRVDomain, "."),
+			Host:       target,
+			PortString: strconv.Itoa(int(srv.Port)),
+			Port:       int(srv.Port),
+			Source:     "srv",
+		}
+		for _, addr := range addrs {
+			a.addIP(addr.IP)
+		}
+		cs.peerCandidates <- a
+	}
+	return false
+}
+
+// orderSRV puts the records in the order peers should be tried: lowest priority first, then
+// highest weight. The resolver shuffles by weight within a priority, but our peer list and the
+// election should not change from one poll to the next, so the order here is stable.
+func orderSRV(records []*net.SRV) []*net.SRV {
+	ordered := append([]*net.SRV{}, records...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if a.Weight != b.Weight {
+			return a.Weight > b.Weight
+		}
+		return a.Target < b.Target
+	})
+	return ordered
+}
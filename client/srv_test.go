@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver answers from maps, as a configured DNS server would
+type fakeResolver struct {
+	srv   map[string][]*net.SRV
+	hosts map[string][]net.IP
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error) {
+	records, ok := r.srv[name]
+	if !ok {
+		return "", nil, fmt.Errorf("no such name %s", name)
+	}
+	return name, records, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+func srvTestConfig() *common.Config {
+	return &common.Config{SRVName: "_etcd-server._tcp", SRVDomain: "example.com"}
+}
+
+func pollSRV(cs *ClientState, d *srvDiscoverer) []*AvahiBrowseResult {
+	d.Poll(cs)
+	results := make([]*AvahiBrowseResult, 0)
+	for len(cs.peerCandidates) > 0 {
+		results = append(results, <-cs.peerCandidates)
+	}
+	return results
+}
+
+func TestSRVOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []*net.SRV
+		want    []string
+	}{
+		{
+			name: "priority",
+			records: []*net.SRV{
+				{Target: "c.example.com.", Port: 2380, Priority: 20, Weight: 0},
+				{Target: "a.example.com.", Port: 2380, Priority: 10, Weight: 0},
+				{Target: "b.example.com.", Port: 2380, Priority: 15, Weight: 0},
+			},
+			want: []string{"a.example.com", "b.example.com", "c.example.com"},
+		},
+		{
+			name: "weight within priority",
+			records: []*net.SRV{
+				{Target: "light.example.com.", Port: 2380, Priority: 10, Weight: 10},
+				{Target: "backup.example.com.", Port: 2380, Priority: 20, Weight: 100},
+				{Target: "heavy.example.com.", Port: 2380, Priority: 10, Weight: 60},
+			},
+			want: []string{"heavy.example.com", "light.example.com", "backup.example.com"},
+		},
+		{
+			name: "ties by target",
+			records: []*net.SRV{
+				{Target: "b.example.com.", Port: 2380, Priority: 0, Weight: 0},
+				{Target: "a.example.com.", Port: 2380, Priority: 0, Weight: 0},
+			},
+			want: []string{"a.example.com", "b.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		resolver := &fakeResolver{
+			srv:   map[string][]*net.SRV{"_etcd-server._tcp.example.com": tt.records},
+			hosts: make(map[string][]net.IP),
+		}
+		for i, r := range tt.records {
+			resolver.hosts[strings.TrimSuffix(r.Target, ".")] = []net.IP{net.IPv4(10, 0, 0, byte(i+1))}
+		}
+		results := pollSRV(newTestState(srvTestConfig(), nil), &srvDiscoverer{lookup: resolver})
+		got := make([]string, 0, len(results))
+		for _, a := range results {
+			got = append(got, a.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got order %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSRVEntries(t *testing.T) {
+	resolver := &fakeResolver{
+		srv: map[string][]*net.SRV{"_etcd-server._tcp.example.com": {
+			{Target: "dual.example.com.", Port: 2380, Priority: 0, Weight: 0},
+			{Target: "missing.example.com.", Port: 2380, Priority: 0, Weight: 0},
+			{Target: "v6.example.com.", Port: 7001, Priority: 1, Weight: 0},
+		}},
+		hosts: map[string][]net.IP{
+			"dual.example.com": {net.ParseIP("fd00::1"), net.IPv4(10, 0, 0, 1)},
+			"v6.example.com":   {net.ParseIP("fe80::1"), net.ParseIP("fd00::2")},
+		},
+	}
+	results := pollSRV(newTestState(srvTestConfig(), nil), &srvDiscoverer{lookup: resolver})
+	if len(results) != 2 {
+		t.Fatalf("got %d entries, want 2 (unresolvable target skipped)", len(results))
+	}
+	dual, v6 := results[0], results[1]
+	if dual.Port != 2380 || !dual.IPv4.Equal(net.IPv4(10, 0, 0, 1)) || !dual.IPv6.Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("dual-stack entry: port %d IPv4 %v IPv6 %v", dual.Port, dual.IPv4, dual.IPv6)
+	}
+	if v6.Port != 7001 || v6.IPv4 != nil || !v6.IPv6.Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("IPv6 entry: port %d IPv4 %v IPv6 %v; want the global address", v6.Port, v6.IPv4, v6.IPv6)
+	}
+	if dual.Source != "srv" || dual.TXT != nil {
+		t.Errorf("entry source '%s' TXT %v; want srv with no TXT", dual.Source, dual.TXT)
+	}
+}
+
+// serveDNS answers SRV and A queries over UDP from the given records until the conn is closed
+func serveDNS(conn net.PacketConn, srv map[string][]dnsmessage.SRVResource, a map[string][4]byte) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		q := query.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.Header.ID, Response: true, Authoritative: true},
+			Questions: query.Questions,
+		}
+		header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		switch q.Type {
+		case dnsmessage.TypeSRV:
+			for _, r := range srv[q.Name.String()] {
+				body := r
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &body})
+			}
+		case dnsmessage.TypeA:
+			if ip, ok := a[q.Name.String()]; ok {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: ip}})
+			}
+		}
+		_, isSRV := srv[q.Name.String()]
+		_, isHost := a[q.Name.String()]
+		if !isSRV && !isHost {
+			resp.Header.RCode = dnsmessage.RCodeNameError
+		}
+		if packed, err := resp.Pack(); err == nil {
+			conn.WriteTo(packed, addr)
+		}
+	}
+}
+
+func TestSRVResolverFlag(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveDNS(conn,
+		map[string][]dnsmessage.SRVResource{"_etcd-server._tcp.example.com.": {
+			{Priority: 20, Weight: 0, Port: 2380, Target: dnsmessage.MustNewName("b.example.com.")},
+			{Priority: 10, Weight: 0, Port: 2380, Target: dnsmessage.MustNewName("a.example.com.")},
+		}},
+		map[string][4]byte{"a.example.com.": {10, 0, 0, 1}, "b.example.com.": {10, 0, 0, 2}})
+
+	cs := newTestState(srvTestConfig(), nil)
+	cs.cfg.SRVResolver = conn.LocalAddr().String()
+	results := pollSRV(cs, &srvDiscoverer{})
+	if len(results) != 2 {
+		t.Fatalf("got %d entries through --srv_resolver %s, want 2", len(results), cs.cfg.SRVResolver)
+	}
+	if results[0].Name != "a.example.com" || !results[0].IPv4.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("first entry %s %v; want a.example.com 10.0.0.1", results[0].Name, results[0].IPv4)
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// staticDiscoverer probes a fixed list of seed addresses plus the contents of a peers file,
+// for networks where multicast and broadcast are blocked entirely
+type staticDiscoverer struct{}
+
+func (d *staticDiscoverer) Name() string {
+	return "static"
+}
+
+func (d *staticDiscoverer) seeds(cs *ClientState) []string {
+	seeds := make([]string, 0)
+	for _, s := range cs.cfg.Seeds {
+		seeds = append(seeds, strings.Split(s, ",")...)
+	}
+	// the peers file is re-read every poll so that it can be updated while we wait
+	if cs.cfg.PeersFile != "" {
+		if fileData, err := ioutil.ReadFile(cs.cfg.PeersFile); err != nil {
+			fmt.Printf("Could not read peers file '%s': %s\n", cs.cfg.PeersFile, err.Error())
+		} else {
+			for _, line := range strings.Split(string(fileData), "\n") {
+				if i := strings.Index(line, "#"); i >= 0 {
+					line = line[:i]
+				}
+				seeds = append(seeds, strings.Fields(line)...)
+			}
+		}
+	}
+	return seeds
+}
+
+func (d *staticDiscoverer) Poll(cs *ClientState) bool {
+	for _, seed := range d.seeds(cs) {
+		seed = strings.TrimSpace(seed)
+		if seed == "" {
+			continue
+		}
+		host, portString, err := net.SplitHostPort(seed)
+		if err != nil {
+			// no port given; assume the same peer port as ours
+			host = seed
+			portString = strconv.Itoa(cs.etcd.PeerPort)
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			fmt.Printf("Invalid port in seed '%s'\n", seed)
+			continue
+		}
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			if ips, err = net.LookupIP(host); err != nil {
+				fmt.Printf("Could not resolve seed '%s': %s\n", seed, err.Error())
+				continue
+			}
+		}
+		a := &AvahiBrowseResult{
+			Type:       "=",
+			Protocol:   "IPv4",
+			Name:       host,
+			Host:       host,
+			PortString: portString,
+			Port:       port,
+			Source:     "static",
+		}
+		for _, ip := range ips {
+			a.addIP(ip)
+		}
+		cs.peerCandidates <- a
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package client
+
+/*
+
+UDP broadcast discovery
+
+Every poll, each node broadcasts a small announcement on every non-loopback interface and listens
+for the announcements of others. Wire format, version 2 (all integers big endian):
+
+	magic        4 bytes  "SRPD"
+	version      1 byte   2
+	state        1 byte   0 = booting, 1 = server, 2 = proxy
+	peer port    2 bytes
+	client port  2 bytes
+	uuid length  1 byte
+	uuid         uuid length bytes
+	attr count   1 byte
+	attrs        attr count times:
+	               key length    1 byte
+	               key           key length bytes
+	               value length  1 byte
+	               value         value length bytes
+
+The attributes carry the same key/values as our mDNS TXT record (cluster name and so on), and
+win over the header fields where both say the same thing. Version 1 packets are the same
+without the attributes, and are still accepted.
+
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const udpMagic = "SRPD"
+const udpVersion = 2
+const udpHeaderLen = 11
+
+const (
+	udpStateBooting = 0
+	udpStateServer  = 1
+	udpStateProxy   = 2
+)
+
+var udpStateNames = map[byte]string{
+	udpStateBooting: roleBooting,
+	udpStateServer:  roleServer,
+	udpStateProxy:   roleProxy,
+}
+
+func udpStateForRole(role string) byte {
+	for state, name := range udpStateNames {
+		if name == role {
+			return state
+		}
+	}
+	return udpStateBooting
+}
+
+type udpAnnouncement struct {
+	State      byte
+	PeerPort   int
+	ClientPort int
+	UUID       string
+	Attrs      []string // key=value
+}
+
+func (a *udpAnnouncement) marshal() []byte {
+	b := make([]byte, udpHeaderLen, udpHeaderLen+len(a.UUID))
+	copy(b[0:4], udpMagic)
+	b[4] = udpVersion
+	b[5] = a.State
+	binary.BigEndian.PutUint16(b[6:8], uint16(a.PeerPort))
+	binary.BigEndian.PutUint16(b[8:10], uint16(a.ClientPort))
+	b[10] = byte(len(a.UUID))
+	b = append(b, a.UUID...)
+
+	attrs := make([][2]string, 0, len(a.Attrs))
+	for _, attr := range a.Attrs {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 || len(kv[0]) > 255 || len(kv[1]) > 255 || len(attrs) == 255 {
+			continue
+		}
+		attrs = append(attrs, [2]string{kv[0], kv[1]})
+	}
+	b = append(b, byte(len(attrs)))
+	for _, kv := range attrs {
+		b = append(b, byte(len(kv[0])))
+		b = append(b, kv[0]...)
+		b = append(b, byte(len(kv[1])))
+		b = append(b, kv[1]...)
+	}
+	return b
+}
+
+func unmarshalUDPAnnouncement(b []byte) (*udpAnnouncement, error) {
+	if len(b) < udpHeaderLen || string(b[0:4]) != udpMagic {
+		return nil, fmt.Errorf("not a peer discovery packet")
+	}
+	if b[4] != 1 && b[4] != udpVersion {
+		return nil, fmt.Errorf("unsupported peer discovery packet version %d", b[4])
+	}
+	uuidLen := int(b[10])
+	if len(b) < udpHeaderLen+uuidLen {
+		return nil, fmt.Errorf("truncated peer discovery packet")
+	}
+	a := &udpAnnouncement{
+		State:      b[5],
+		PeerPort:   int(binary.BigEndian.Uint16(b[6:8])),
+		ClientPort: int(binary.BigEndian.Uint16(b[8:10])),
+		UUID:       string(b[udpHeaderLen : udpHeaderLen+uuidLen]),
+		Attrs:      make([]string, 0),
+	}
+	if b[4] == 1 {
+		return a, nil
+	}
+
+	rest := b[udpHeaderLen+uuidLen:]
+	if len(rest) < 1 {
+		return nil, fmt.Errorf("truncated peer discovery packet")
+	}
+	count := int(rest[0])
+	rest = rest[1:]
+	for i := 0; i < count; i++ {
+		var kv [2]string
+		for j := range kv {
+			if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+				return nil, fmt.Errorf("truncated peer discovery packet attributes")
+			}
+			kv[j] = string(rest[1 : 1+int(rest[0])])
+			rest = rest[1+int(rest[0]):]
+		}
+		a.Attrs = append(a.Attrs, kv[0]+"="+kv[1])
+	}
+	return a, nil
+}
+
+func broadcastAddrs() []net.IP {
+	result := make([]net.IP, 0)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		fmt.Printf("broadcastAddrs: Error getting interfaces: %s\n", err.Error())
+		return result
+	}
+	for _, iface := range ifaces {
+		if (iface.Flags&net.FlagLoopback) != 0 || (iface.Flags&net.FlagUp) == 0 || (iface.Flags&net.FlagBroadcast) == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+				continue
+			}
+			ip := ipnet.IP.To4()
+			bcast := make(net.IP, net.IPv4len)
+			for i := range ip {
+				bcast[i] = ip[i] | ^ipnet.Mask[i]
+			}
+			result = append(result, bcast)
+		}
+	}
+	return result
+}
+
+// udpDiscoverer announces and listens for peers with UDP broadcast
+type udpDiscoverer struct {
+	conn *net.UDPConn
+}
+
+func (d *udpDiscoverer) Name() string {
+	return "udp"
+}
+
+func (d *udpDiscoverer) Poll(cs *ClientState) bool {
+	if d.conn == nil {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: cs.cfg.UDPPort})
+		if err != nil {
+			fmt.Printf("Error listening for UDP announcements on port %d: %s\n", cs.cfg.UDPPort, err.Error())
+			return false
+		}
+		d.conn = conn
+		go d.listen(cs)
+	}
+
+	announcement := &udpAnnouncement{
+		State:      udpStateForRole(cs.role),
+		PeerPort:   cs.etcd.PeerPort,
+		ClientPort: cs.etcd.ClientPort,
+		UUID:       cs.cfg.UUID,
+		Attrs:      cs.txtRecords(),
+	}
+	packet := announcement.marshal()
+	for _, bcast := range broadcastAddrs() {
+		if _, err := d.conn.WriteToUDP(packet, &net.UDPAddr{IP: bcast, Port: cs.cfg.UDPPort}); err != nil {
+			fmt.Printf("Error sending UDP announcement to %s: %s\n", bcast.String(), err.Error())
+		}
+	}
+	return false
+}
+
+func (d *udpDiscoverer) listen(cs *ClientState) {
+	buf := make([]byte, 65536)
+	for {
+		n, src, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("Error reading UDP announcement: %s\n", err.Error())
+			return
+		}
+		a, err := unmarshalUDPAnnouncement(buf[:n])
+		if err != nil {
+			fmt.Printf("Ignoring UDP packet from %s: %s\n", src.String(), err.Error())
+			continue
+		}
+		if a.UUID == cs.cfg.UUID {
+			// our own broadcast
+			continue
+		}
+		// the attributes come first so they win over the header; version 1 packets only have the header
+		txt := append([]string{}, a.Attrs...)
+		if _, ok := txtValue(txt, "role"); !ok {
+			txt = append(txt, "role="+udpStateNames[a.State])
+		}
+		if _, ok := txtValue(txt, "client_port"); !ok {
+			txt = append(txt, "client_port="+strconv.Itoa(a.ClientPort))
+		}
+		cs.peerCandidates <- &AvahiBrowseResult{
+			Type:       "=",
+			Protocol:   "IPv4",
+			Name:       a.UUID,
+			Service:    cs.cfg.MDNSService,
+			Host:       src.IP.String(),
+			IPString:   src.IP.String(),
+			IPv4:       src.IP.To4(),
+			PortString: strconv.Itoa(a.PeerPort),
+			Port:       a.PeerPort,
+			TXT:        txt,
+			Source:     "udp",
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUDPAnnouncementRoundTrip(t *testing.T) {
+	tests := []udpAnnouncement{
+		{State: udpStateBooting, PeerPort: 2380, ClientPort: 2379, UUID: "0a1b2c3d4e5f"},
+		{State: udpStateServer, PeerPort: 7001, ClientPort: 4001, UUID: strings.Repeat("u", 255)},
+		{State: udpStateBooting, PeerPort: 65535, ClientPort: 1},
+		{State: udpStateProxy, PeerPort: 2380, ClientPort: 2379, UUID: "proxy", Attrs: []string{"cluster=prod", "role=proxy", "empty="}},
+	}
+	for _, want := range tests {
+		if want.Attrs == nil {
+			want.Attrs = []string{}
+		}
+		got, err := unmarshalUDPAnnouncement(want.marshal())
+		if err != nil {
+			t.Errorf("%+v: %s", want, err.Error())
+		} else if !reflect.DeepEqual(*got, want) {
+			t.Errorf("round trip gave %+v, want %+v", *got, want)
+		}
+	}
+}
+
+func TestUDPStateForRole(t *testing.T) {
+	for state, role := range udpStateNames {
+		if got := udpStateForRole(role); got != state {
+			t.Errorf("role '%s' announced as state %d, want %d", role, got, state)
+		}
+	}
+	if got := udpStateForRole("unknown"); got != udpStateBooting {
+		t.Errorf("unknown role announced as state %d, want booting", got)
+	}
+}
+
+func TestUDPAnnouncementTruncated(t *testing.T) {
+	packet := (&udpAnnouncement{State: udpStateServer, PeerPort: 2380, ClientPort: 2379, UUID: "0a1b2c3d4e5f"}).marshal()
+	for n := 0; n < len(packet); n++ {
+		if a, err := unmarshalUDPAnnouncement(packet[:n]); err == nil {
+			t.Errorf("%d of %d bytes accepted as %+v", n, len(packet), *a)
+		}
+	}
+
+	other := append([]byte{}, packet...)
+	copy(other, "XXXX")
+	if _, err := unmarshalUDPAnnouncement(other); err == nil {
+		t.Errorf("packet with the wrong magic accepted")
+	}
+	// version 1 is the same header without the attribute count
+	v1 := append([]byte{}, packet[:len(packet)-1]...)
+	v1[4] = 1
+	if a, err := unmarshalUDPAnnouncement(v1); err != nil || a.UUID != "0a1b2c3d4e5f" || len(a.Attrs) != 0 {
+		t.Errorf("version 1 packet: %+v, %v", a, err)
+	}
+	future := append([]byte{}, packet...)
+	future[4] = udpVersion + 1
+	if _, err := unmarshalUDPAnnouncement(future); err == nil {
+		t.Errorf("packet from a future version accepted")
+	}
+}
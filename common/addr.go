@@ -0,0 +1,127 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Address families for --addr_family. The prefer_ modes take the other family when a peer (or
+// this host) has nothing in the preferred one, so dual-stack and single-stack nodes can mix.
+const (
+	AddrFamilyIPv4       = "ipv4"
+	AddrFamilyIPv6       = "ipv6"
+	AddrFamilyPreferIPv4 = "prefer_ipv4"
+	AddrFamilyPreferIPv6 = "prefer_ipv6"
+)
+
+func validAddrFamily(family string) bool {
+	switch family {
+	case AddrFamilyIPv4, AddrFamilyIPv6, AddrFamilyPreferIPv4, AddrFamilyPreferIPv6:
+		return true
+	}
+	return false
+}
+
+// PickAddr chooses between an IPv4 and an IPv6 address (either may be nil) according to
+// --addr_family. It returns nil if neither is acceptable.
+func (c *EtcdConfig) PickAddr(ipv4 net.IP, ipv6 net.IP) net.IP {
+	switch c.AddrFamily {
+	case AddrFamilyIPv4:
+		return nilIP(ipv4)
+	case AddrFamilyIPv6:
+		return nilIP(ipv6)
+	case AddrFamilyPreferIPv6:
+		if ipv6 != nil {
+			return ipv6
+		}
+		return nilIP(ipv4)
+	default:
+		if ipv4 != nil {
+			return ipv4
+		}
+		return nilIP(ipv6)
+	}
+}
+
+// nilIP keeps a nil net.IP nil rather than an empty slice
+func nilIP(ip net.IP) net.IP {
+	if len(ip) == 0 {
+		return nil
+	}
+	return ip
+}
+
+// IsIPv6LinkLocal addresses only mean something together with the zone (interface) they are on
+func IsIPv6LinkLocal(ip net.IP) bool {
+	return ip.To4() == nil && ip.IsLinkLocalUnicast()
+}
+
+// ZonedHost is the textual address, with %zone appended for IPv6 link-local addresses
+func ZonedHost(ip net.IP, zone string) string {
+	if zone != "" && IsIPv6LinkLocal(ip) {
+		return ip.String() + "%" + zone
+	}
+	return ip.String()
+}
+
+// SplitZone parses an address that may carry a zone, e.g. fe80::1%eth0
+func SplitZone(host string) (net.IP, string) {
+	zone := ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	return net.ParseIP(host), zone
+}
+
+// HostPort formats host:port for conf files and dialing, bracketing IPv6 addresses
+func HostPort(ip net.IP, zone string, port int) string {
+	return net.JoinHostPort(ZonedHost(ip, zone), strconv.Itoa(port))
+}
+
+// joinHostPort is HostPort for an address we only have as a string, e.g. --etcd_peer_addr
+func joinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// URLHost is HostPort for use in a URL, where the zone separator is escaped (RFC 6874)
+func URLHost(ip net.IP, zone string, port int) string {
+	return urlHostPort(ZonedHost(ip, zone), port)
+}
+
+// urlHostPort is URLHost for an address we only have as a string
+func urlHostPort(host string, port int) string {
+	return net.JoinHostPort(strings.Replace(host, "%", "%25", 1), strconv.Itoa(port))
+}
+
+// Zone is the interface the peer was found on, which link-local addresses need
+func (p EtcdPeer) Zone() string {
+	if p.Interface == nil {
+		return ""
+	}
+	return p.Interface.Name
+}
+
+// unspecifiedFor is the wildcard bind address in the same family as addr
+func unspecifiedFor(addr string) string {
+	if ip, _ := SplitZone(addr); ip != nil && ip.To4() == nil {
+		return "::"
+	}
+	return "0.0.0.0"
+}
+
+// loopbackFor is the loopback address in the preferred family
+func (c *EtcdConfig) loopbackFor() string {
+	if c.AddrFamily == AddrFamilyIPv6 || c.AddrFamily == AddrFamilyPreferIPv6 {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
+func (c *EtcdConfig) checkAddrFamily() error {
+	if !validAddrFamily(c.AddrFamily) {
+		return fmt.Errorf("Unknown address family '%s'", c.AddrFamily)
+	}
+	return nil
+}
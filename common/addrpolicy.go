@@ -0,0 +1,176 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Address selection policy for multi-homed hosts. Every address we might take as our own, and
+// every peer we would reach through one of our addresses, is checked against
+// --iface_include/--iface_exclude and --allow_cidr/--deny_cidr. With --prefer_default_route,
+// addresses on the interface of the default route are tried first.
+
+var ProcNetRoutePath string = "/proc/net/route"
+var ProcNetIPv6RoutePath string = "/proc/net/ipv6_route"
+
+// splitList flattens flags that may be repeated or comma separated
+func splitList(values []string) []string {
+	result := make([]string, 0)
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, s := range splitList(values) {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR '%s': %s", s, err.Error())
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func (c *EtcdConfig) loadAddrPolicy() error {
+	var err error
+	c.IfaceInclude = splitList(c.IfaceInclude)
+	c.IfaceExclude = splitList(c.IfaceExclude)
+	for _, glob := range append(append([]string{}, c.IfaceInclude...), c.IfaceExclude...) {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return fmt.Errorf("Invalid interface glob '%s': %s", glob, err.Error())
+		}
+	}
+	if c.allowNets, err = parseCIDRs(c.AllowCIDRs); err != nil {
+		return err
+	}
+	if c.denyNets, err = parseCIDRs(c.DenyCIDRs); err != nil {
+		return err
+	}
+	return nil
+}
+
+func matchGlob(globs []string, name string) (string, bool) {
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return glob, true
+		}
+	}
+	return "", false
+}
+
+// ifaceIncluded: explicitly named by --iface_include, which also lets in virtual interfaces
+func (c *EtcdConfig) ifaceIncluded(iface *net.Interface) bool {
+	_, ok := matchGlob(c.IfaceInclude, iface.Name)
+	return ok
+}
+
+// CheckAddrPolicy says why ip on iface may not be used as our address, or nil if it may
+func (c *EtcdConfig) CheckAddrPolicy(iface *net.Interface, ip net.IP) error {
+	if iface != nil {
+		if glob, ok := matchGlob(c.IfaceExclude, iface.Name); ok {
+			return fmt.Errorf("interface %s matches --iface_exclude '%s'", iface.Name, glob)
+		}
+		if len(c.IfaceInclude) > 0 && !c.ifaceIncluded(iface) {
+			return fmt.Errorf("interface %s does not match --iface_include", iface.Name)
+		}
+	}
+	for _, ipnet := range c.denyNets {
+		if ipnet.Contains(ip) {
+			return fmt.Errorf("%s is in --deny_cidr %s", ip.String(), ipnet.String())
+		}
+	}
+	if len(c.allowNets) > 0 {
+		for _, ipnet := range c.allowNets {
+			if ipnet.Contains(ip) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not in any --allow_cidr", ip.String())
+	}
+	return nil
+}
+
+// DefaultRouteInterfaces reads the kernel routing tables for the interfaces holding a default
+// route, IPv4 first, lowest metric first within each (linux specific)
+func DefaultRouteInterfaces() []string {
+	names := make([]string, 0)
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+	for _, name := range defaultRoutes(ProcNetRoutePath, 0, 1, 7, 6, 10, "00000000") {
+		names = appendUnique(names, name)
+	}
+	// Destination PrefixLen Source SourcePrefixLen NextHop Metric RefCnt Use Flags Iface
+	for _, name := range defaultRoutes(ProcNetIPv6RoutePath, 9, 0, 1, 5, 16, "00") {
+		names = appendUnique(names, name)
+	}
+	return names
+}
+
+// defaultRoutes returns the interfaces of routes to the zero destination with a zero length
+// mask, sorted by metric. The column layout and metric base differ between the IPv4 and IPv6
+// tables.
+func defaultRoutes(path string, ifaceCol int, destCol int, maskCol int, metricCol int, metricBase int, zeroMask string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return []string{}
+	}
+	defer f.Close()
+
+	type route struct {
+		iface  string
+		metric int64
+	}
+	routes := make([]route, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= ifaceCol || len(fields) <= destCol || len(fields) <= maskCol || len(fields) <= metricCol {
+			continue
+		}
+		if strings.Trim(fields[destCol], "0") != "" || fields[maskCol] != zeroMask || fields[ifaceCol] == "lo" {
+			continue
+		}
+		metric, err := strconv.ParseInt(fields[metricCol], metricBase, 64)
+		if err != nil {
+			continue
+		}
+		r := route{iface: fields[ifaceCol], metric: metric}
+		i := len(routes)
+		for i > 0 && routes[i-1].metric > r.metric {
+			i--
+		}
+		routes = append(routes[:i], append([]route{r}, routes[i:]...)...)
+	}
+	names := make([]string, 0, len(routes))
+	for _, r := range routes {
+		names = append(names, r.iface)
+	}
+	return names
+}
+
+func hasString(list []string, s string) bool {
+	for _, existing := range list {
+		if existing == s {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique(list []string, s string) []string {
+	if hasString(list, s) {
+		return list
+	}
+	return append(list, s)
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckAddrPolicy(t *testing.T) {
+	eth0 := &net.Interface{Name: "eth0"}
+	docker0 := &net.Interface{Name: "docker0"}
+	veth := &net.Interface{Name: "veth1a2b"}
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		allow   []string
+		deny    []string
+		iface   *net.Interface
+		ip      string
+		wantErr bool
+	}{
+		{name: "no policy", iface: eth0, ip: "10.0.0.9"},
+		{name: "excluded by glob", exclude: []string{"docker0,veth*"}, iface: veth, ip: "172.17.0.2", wantErr: true},
+		{name: "not excluded", exclude: []string{"docker0", "veth*"}, iface: eth0, ip: "10.0.0.9"},
+		{name: "included", include: []string{"eth*"}, iface: eth0, ip: "10.0.0.9"},
+		{name: "not included", include: []string{"eth*"}, iface: docker0, ip: "172.17.0.1", wantErr: true},
+		{name: "exclude wins over include", include: []string{"*"}, exclude: []string{"docker*"}, iface: docker0, ip: "172.17.0.1", wantErr: true},
+		{name: "no interface", include: []string{"eth*"}, ip: "10.0.0.9"},
+		{name: "allowed", allow: []string{"10.0.0.0/8"}, iface: eth0, ip: "10.0.0.9"},
+		{name: "not allowed", allow: []string{"10.0.0.0/8,192.168.0.0/16"}, iface: eth0, ip: "172.16.0.9", wantErr: true},
+		{name: "denied", deny: []string{"10.0.0.0/24"}, iface: eth0, ip: "10.0.0.9", wantErr: true},
+		{name: "deny wins over allow", allow: []string{"10.0.0.0/8"}, deny: []string{"10.0.0.0/24"}, iface: eth0, ip: "10.0.0.9", wantErr: true},
+		{name: "IPv6 allowed", allow: []string{"fd00::/8"}, iface: eth0, ip: "fd00::9"},
+		{name: "IPv6 not in IPv4 allow", allow: []string{"10.0.0.0/8"}, iface: eth0, ip: "fd00::9", wantErr: true},
+	}
+	for _, tt := range tests {
+		c := &EtcdConfig{IfaceInclude: tt.include, IfaceExclude: tt.exclude, AllowCIDRs: tt.allow, DenyCIDRs: tt.deny}
+		if err := c.loadAddrPolicy(); err != nil {
+			t.Fatalf("%s: %s", tt.name, err.Error())
+		}
+		err := c.CheckAddrPolicy(tt.iface, net.ParseIP(tt.ip))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: CheckAddrPolicy returned %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	for _, c := range []*EtcdConfig{
+		{AllowCIDRs: []string{"10.0.0.0"}},
+		{DenyCIDRs: []string{"10.0.0.0/33"}},
+		{IfaceExclude: []string{"eth["}},
+	} {
+		if err := c.loadAddrPolicy(); err == nil {
+			t.Errorf("invalid policy %+v accepted", c)
+		}
+	}
+}
+
+const testRoute = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+lo	00000000	00000000	0001	0	0	0	00000000	0	0	0
+wlan0	00000000	0101A8C0	0003	0	0	600	00000000	0	0	0
+eth0	00000000	0100000A	0003	0	0	100	00000000	0	0	0
+eth0	0000000A	00000000	0001	0	0	100	00FFFFFF	0	0	0
+docker0	000011AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+`
+
+// Destination PrefixLen Source SourcePrefixLen NextHop Metric RefCnt Use Flags Iface; the
+// metric is hex here, unlike the IPv4 table
+const testIPv6Route = `fd000000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth1
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 0000000a 00000001 00000000 00000003     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo
+`
+
+func TestDefaultRouteInterfaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedRoute, savedIPv6Route := ProcNetRoutePath, ProcNetIPv6RoutePath
+	defer func() { ProcNetRoutePath, ProcNetIPv6RoutePath = savedRoute, savedIPv6Route }()
+
+	ProcNetRoutePath = filepath.Join(dir, "route")
+	ProcNetIPv6RoutePath = filepath.Join(dir, "ipv6_route")
+	ioutil.WriteFile(ProcNetRoutePath, []byte(testRoute), 0644)
+	ioutil.WriteFile(ProcNetIPv6RoutePath, []byte(testIPv6Route), 0644)
+	// IPv4 by metric, then the IPv6-only eth1; eth0 appears once
+	if got := strings.Join(DefaultRouteInterfaces(), ","); got != "eth0,wlan0,eth1" {
+		t.Errorf("default route interfaces %s, want eth0,wlan0,eth1", got)
+	}
+
+	os.Remove(ProcNetRoutePath)
+	if got := strings.Join(DefaultRouteInterfaces(), ","); got != "eth0,eth1" {
+		t.Errorf("without an IPv4 table: %s, want eth0,eth1", got)
+	}
+	os.Remove(ProcNetIPv6RoutePath)
+	if got := DefaultRouteInterfaces(); len(got) != 0 {
+		t.Errorf("without routing tables: %v, want none", got)
+	}
+}
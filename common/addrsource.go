@@ -0,0 +1,216 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Address sources for --addr_from, tried in order until one gives an address that verifies as
+// one of ours. Public addresses on EC2 and GCE are NATed rather than on an interface, so they
+// will not verify; they are there for hosts where they are.
+
+// AddressSource looks up an address for this host from somewhere other than its interfaces
+type AddressSource interface {
+	Name() string
+	Lookup() (net.IP, error)
+}
+
+var EtcEnvironmentPath string = "/etc/environment"
+
+var EC2MetadataURL string = "http://169.254.169.254/latest/"
+var GCEMetadataURL string = "http://metadata.google.internal/computeMetadata/v1/"
+var OpenStackMetadataURL string = "http://169.254.169.254/latest/"
+var DigitalOceanMetadataURL string = "http://169.254.169.254/metadata/v1/"
+
+// metadata servers are link-local and answer at once, or not at all
+var MetadataTimeout time.Duration = 2 * time.Second
+
+// the metadata URLs are read at lookup time, so that they can be pointed at a stand-in server
+var addressSources = map[string]AddressSource{
+	"coreos_private":       &envFileSource{key: "COREOS_PRIVATE_IPV4"},
+	"coreos_public":        &envFileSource{key: "COREOS_PUBLIC_IPV4"},
+	"ec2_private":          &ec2Source{name: "ec2_private", base: &EC2MetadataURL, path: "meta-data/local-ipv4"},
+	"ec2_public":           &ec2Source{name: "ec2_public", base: &EC2MetadataURL, path: "meta-data/public-ipv4"},
+	"gce_private":          &gceSource{name: "gce_private", path: "instance/network-interfaces/0/ip"},
+	"gce_public":           &gceSource{name: "gce_public", path: "instance/network-interfaces/0/access-configs/0/external-ip"},
+	"openstack_private":    &ec2Source{name: "openstack_private", base: &OpenStackMetadataURL, path: "meta-data/local-ipv4"},
+	"openstack_public":     &ec2Source{name: "openstack_public", base: &OpenStackMetadataURL, path: "meta-data/public-ipv4"},
+	"digitalocean_private": &digitalOceanSource{name: "digitalocean_private", path: "interfaces/private/0/ipv4/address"},
+	"digitalocean_public":  &digitalOceanSource{name: "digitalocean_public", path: "interfaces/public/0/ipv4/address"},
+}
+
+// newAddressSources parses the --addr_from chain. Anything that is not a source name is a file
+// holding the address, like the default /etc/private_ipv4.
+func newAddressSources(chain string) []AddressSource {
+	sources := make([]AddressSource, 0)
+	for _, name := range splitList([]string{chain}) {
+		if source, ok := addressSources[name]; ok {
+			sources = append(sources, source)
+		} else {
+			sources = append(sources, &fileSource{path: strings.TrimPrefix(name, "file:")})
+		}
+	}
+	return sources
+}
+
+func parseAddr(s string, source string) (net.IP, error) {
+	s = strings.TrimSpace(s)
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP address '%s' found in '%s'", s, source)
+	}
+	return ip, nil
+}
+
+// fileSource: a file holding just the address
+type fileSource struct {
+	path string
+}
+
+func (s *fileSource) Name() string {
+	return s.path
+}
+
+func (s *fileSource) Lookup() (net.IP, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return parseAddr(string(data), s.path)
+}
+
+// envFileSource: a KEY=value line in /etc/environment, as CoreOS writes
+type envFileSource struct {
+	key string
+}
+
+func (s *envFileSource) Name() string {
+	return EtcEnvironmentPath + " " + s.key
+}
+
+func (s *envFileSource) Lookup() (net.IP, error) {
+	f, err := os.Open(EtcEnvironmentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "export ")
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 && strings.TrimSpace(kv[0]) == s.key {
+			return parseAddr(strings.Trim(strings.TrimSpace(kv[1]), "\"'"), s.Name())
+		}
+	}
+	return nil, fmt.Errorf("%s not set in %s", s.key, EtcEnvironmentPath)
+}
+
+// metadataTransport is shared so that lookups reuse its connections rather than each leaving
+// its own open; it never goes through a proxy
+var metadataTransport = &http.Transport{Proxy: nil}
+
+// metadataGet fetches one value from a metadata server
+func metadataGet(method string, url string, header http.Header) (string, error) {
+	client := &http.Client{Timeout: MetadataTimeout, Transport: metadataTransport}
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// ec2Source: the EC2 instance metadata service, which OpenStack also provides. IMDSv2 wants a
+// session token first; without one we fall back to plain IMDSv1 requests.
+type ec2Source struct {
+	name string
+	base *string
+	path string
+}
+
+func (s *ec2Source) Name() string {
+	return s.name
+}
+
+func (s *ec2Source) Lookup() (net.IP, error) {
+	header := http.Header{}
+	tokenHeader := http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": []string{"60"}}
+	if token, err := metadataGet("PUT", *s.base+"api/token", tokenHeader); err == nil {
+		header.Set("X-Aws-Ec2-Metadata-Token", strings.TrimSpace(token))
+	}
+	value, err := metadataGet("GET", *s.base+s.path, header)
+	if err != nil {
+		return nil, err
+	}
+	return parseAddr(value, s.name)
+}
+
+// gceSource: the GCE metadata server, which insists on the Metadata-Flavor header
+type gceSource struct {
+	name string
+	path string
+}
+
+func (s *gceSource) Name() string {
+	return s.name
+}
+
+func (s *gceSource) Lookup() (net.IP, error) {
+	value, err := metadataGet("GET", GCEMetadataURL+s.path, http.Header{"Metadata-Flavor": []string{"Google"}})
+	if err != nil {
+		return nil, err
+	}
+	return parseAddr(value, s.name)
+}
+
+// digitalOceanSource: the DigitalOcean droplet metadata service
+type digitalOceanSource struct {
+	name string
+	path string
+}
+
+func (s *digitalOceanSource) Name() string {
+	return s.name
+}
+
+func (s *digitalOceanSource) Lookup() (net.IP, error) {
+	value, err := metadataGet("GET", DigitalOceanMetadataURL+s.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseAddr(value, s.name)
+}
+
+// loadAddrSources tries each --addr_from source in turn until one gives an address of ours
+func (c *EtcdConfig) loadAddrSources() {
+	for _, source := range newAddressSources(c.AddrSource) {
+		if c.ClientAddr != "" {
+			return
+		}
+		ip, err := source.Lookup()
+		if os.IsNotExist(err) {
+			// the usual case for /etc/private_ipv4 off CoreOS
+			continue
+		} else if err != nil {
+			fmt.Printf("Address source '%s': %s\n", source.Name(), err.Error())
+			continue
+		}
+		c.verifyIP(ip, source.Name())
+	}
+}
@@ -0,0 +1,165 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeMetadata stands in for the EC2, GCE and DigitalOcean metadata servers at once
+type fakeMetadata struct {
+	values map[string]string // by path
+	token  string            // if set, EC2 hands out this IMDSv2 token and requires it
+}
+
+func (f *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/latest/api/token" {
+		if f.token == "" || r.Method != "PUT" {
+			// an IMDSv1-only service
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(f.token))
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/latest/") && f.token != "" && r.Header.Get("X-Aws-Ec2-Metadata-Token") != f.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/computeMetadata/") && r.Header.Get("Metadata-Flavor") != "Google" {
+		http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+		return
+	}
+	value, ok := f.values[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write([]byte(value + "\n"))
+}
+
+func TestLoadAddrSources(t *testing.T) {
+	// an address on one of our interfaces, which verifyIP will accept
+	ours := ""
+	for _, ip := range LocalAddrs() {
+		if ip.To4() != nil {
+			ours = ip.String()
+			break
+		}
+	}
+	if ours == "" {
+		t.Skip("no non-loopback IPv4 address to test with")
+	}
+	const natted = "203.0.113.9" // a public address that is not on any interface
+
+	dir, err := ioutil.TempDir("", "addrsource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addrFile := filepath.Join(dir, "private_ipv4")
+	ioutil.WriteFile(addrFile, []byte(ours+"\n"), 0644)
+	envFile := filepath.Join(dir, "environment")
+	ioutil.WriteFile(envFile, []byte("export COREOS_PUBLIC_IPV4="+natted+"\nCOREOS_PRIVATE_IPV4=\""+ours+"\"\n"), 0644)
+
+	saved := []string{EC2MetadataURL, GCEMetadataURL, DigitalOceanMetadataURL, EtcEnvironmentPath}
+	defer func() {
+		EC2MetadataURL, GCEMetadataURL, DigitalOceanMetadataURL, EtcEnvironmentPath = saved[0], saved[1], saved[2], saved[3]
+	}()
+	EtcEnvironmentPath = envFile
+
+	tests := []struct {
+		name     string
+		chain    string
+		metadata fakeMetadata
+		want     string // ClientAddr, or "" for none found
+		wantRule string
+	}{
+		{
+			name:     "ec2 IMDSv2",
+			chain:    "ec2_private",
+			metadata: fakeMetadata{token: "t0k3n", values: map[string]string{"/latest/meta-data/local-ipv4": ours}},
+			want:     ours,
+			wantRule: "address from 'ec2_private'",
+		},
+		{
+			name:     "ec2 IMDSv1 fallback",
+			chain:    "ec2_private",
+			metadata: fakeMetadata{values: map[string]string{"/latest/meta-data/local-ipv4": ours}},
+			want:     ours,
+			wantRule: "address from 'ec2_private'",
+		},
+		{
+			name:  "public address is not ours",
+			chain: "ec2_public,ec2_private",
+			metadata: fakeMetadata{values: map[string]string{
+				"/latest/meta-data/public-ipv4": natted,
+				"/latest/meta-data/local-ipv4":  ours,
+			}},
+			want:     ours,
+			wantRule: "address from 'ec2_private'",
+		},
+		{
+			name:     "gce",
+			chain:    "gce_private",
+			metadata: fakeMetadata{values: map[string]string{"/computeMetadata/v1/instance/network-interfaces/0/ip": ours}},
+			want:     ours,
+			wantRule: "address from 'gce_private'",
+		},
+		{
+			name:     "digitalocean",
+			chain:    "digitalocean_private",
+			metadata: fakeMetadata{values: map[string]string{"/metadata/v1/interfaces/private/0/ipv4/address": ours}},
+			want:     ours,
+			wantRule: "address from 'digitalocean_private'",
+		},
+		{
+			name:     "metadata unavailable, then file",
+			chain:    "gce_private,ec2_private," + addrFile,
+			want:     ours,
+			wantRule: "address from '" + addrFile + "'",
+		},
+		{
+			name:     "environment file",
+			chain:    "coreos_public,coreos_private",
+			want:     ours,
+			wantRule: "address from '" + envFile + " COREOS_PRIVATE_IPV4'",
+		},
+		{
+			name:     "invalid address, then file",
+			chain:    "digitalocean_private,file:" + addrFile,
+			metadata: fakeMetadata{values: map[string]string{"/metadata/v1/interfaces/private/0/ipv4/address": "not an address"}},
+			want:     ours,
+			wantRule: "address from '" + addrFile + "'",
+		},
+		{
+			name:  "nothing found",
+			chain: filepath.Join(dir, "missing") + ",ec2_public",
+			metadata: fakeMetadata{values: map[string]string{
+				"/latest/meta-data/public-ipv4": natted,
+			}},
+		},
+	}
+	for _, tt := range tests {
+		metadata := tt.metadata
+		server := httptest.NewServer(&metadata)
+		EC2MetadataURL = server.URL + "/latest/"
+		GCEMetadataURL = server.URL + "/computeMetadata/v1/"
+		DigitalOceanMetadataURL = server.URL + "/metadata/v1/"
+
+		c := &EtcdConfig{AddrSource: tt.chain}
+		c.loadAddrSources()
+		server.Close()
+
+		if c.ClientAddr != tt.want || c.AddrRule != tt.wantRule {
+			t.Errorf("%s: got address '%s' by \"%s\", want '%s' by \"%s\"", tt.name, c.ClientAddr, c.AddrRule, tt.want, tt.wantRule)
+		}
+		if tt.want != "" && c.PeerAddr != tt.want {
+			t.Errorf("%s: peer address '%s', want '%s'", tt.name, c.PeerAddr, tt.want)
+		}
+	}
+}
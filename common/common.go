@@ -1,10 +1,12 @@
 package common
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -28,6 +30,12 @@ func LoadConfigs() (*Config, *EtcdConfig, *FleetConfig, []string, error) {
 }
 
 func LocalNetForIp(fromIP net.IP) (*net.Interface, net.Addr, net.IP, error) {
+	return LocalNetForZonedIp(fromIP, "")
+}
+
+// LocalNetForZonedIp is LocalNetForIp limited to the interface named by zone, if any. Every
+// interface has fe80::/64, so IPv6 link-local addresses are ambiguous without one.
+func LocalNetForZonedIp(fromIP net.IP, zone string) (*net.Interface, net.Addr, net.IP, error) {
 	if ifaces, err := net.Interfaces(); err != nil {
 		return nil, nil, nil, fmt.Errorf("LocalNetForIp: Error getting interfaces: %s\n", err.Error())
 	} else {
@@ -35,6 +43,9 @@ func LocalNetForIp(fromIP net.IP) (*net.Interface, net.Addr, net.IP, error) {
 			if (iface.Flags & net.FlagLoopback) != 0 {
 				continue
 			}
+			if zone != "" && iface.Name != zone {
+				continue
+			}
 			if iface_addrs, err := iface.Addrs(); err != nil {
 				return nil, nil, nil, fmt.Errorf("LocalNetForIp: Error getting interface addresses: %s\n", err.Error())
 			} else {
@@ -46,20 +57,6 @@ func LocalNetForIp(fromIP net.IP) (*net.Interface, net.Addr, net.IP, error) {
 							fmt.Errorf("LocalNetForIp: Error parsing local address '%s': %s\n",
 								ipstr, err.Error())
 					}
-					//fmt.Println("LocalNetForIp", "iface", iface, "ifaceaddr", iface_addr, "ip", ip, "ipnet", ipnet, "from", from)
-					//fromHost, _, err := net.SplitHostPort(from.String())
-					//if err != nil {
-					//	return nil, nil, nil,
-					//		fmt.Errorf("LocalNetForIp: Error parsing from address '%s': %s\n",
-					//			from.String(), err.Error())
-					//}
-					// split away the IPv6 zone if present
-					//fromHost = strings.Split(fromHost, "%")[0]
-					//fromIP := net.ParseIP(fromHost)
-					//if fromIP == nil {
-					//	return nil, nil, nil,
-					//		fmt.Errorf("LocalNetForIp: Error parsing from host '%s'\n", fromHost)
-					//}
 					if ipnet.Contains(fromIP) {
 						return &iface, iface_addr, ip, nil
 					}
@@ -67,7 +64,7 @@ func LocalNetForIp(fromIP net.IP) (*net.Interface, net.Addr, net.IP, error) {
 			}
 		}
 	}
-	return nil, nil, nil, fmt.Errorf("LocalNetForIp: Could not locate local interface/address matching '%s'", fromIP.String())
+	return nil, nil, nil, fmt.Errorf("LocalNetForIp: Could not locate local interface/address matching '%s'", ZonedHost(fromIP, zone))
 }
 
 func InterfaceIsVirtual(iface *net.Interface) bool {
@@ -81,3 +78,31 @@ func InterfaceIsVirtual(iface *net.Interface) bool {
 	}
 	return false
 }
+
+// LocalAddrs returns every non-loopback address on an interface that is up, in numeric order:
+// every address a peer might see us on. IPv4 link-local is left out; IPv6 link-local is kept,
+// since a peer on the same link may only see us on that.
+func LocalAddrs() []net.IP {
+	result := make([]net.IP, 0)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		fmt.Printf("LocalAddrs: Error getting interfaces: %s\n", err.Error())
+		return result
+	}
+	for _, iface := range ifaces {
+		if (iface.Flags&net.FlagLoopback) != 0 || (iface.Flags&net.FlagUp) == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !(ipnet.IP.To4() != nil && ipnet.IP.IsLinkLocalUnicast()) {
+				result = append(result, ipnet.IP)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return bytes.Compare(result[i].To16(), result[j].To16()) < 0 })
+	return result
+}
@@ -16,10 +16,54 @@ type Config struct {
 	MDNSInstance       string `long:"mdns_instance" description:"mDNS instance name (default is uuid)"`
 	MDNSService        string `long:"mdns_service" description:"mDNS service name (default '_scriptrock_etcd._tcp')"`
 	MDNSDomain         string `long:"mdns_domain" description:"mDNS domain (default 'local')"`
+	MDNSBrowser        string `long:"mdns_browser" description:"deprecated, use --discovery: native browses with the mdns backend, avahi with the avahi backend"`
+	MDNSPublisher      string `long:"mdns_publisher" description:"how to announce this node: avahi (service file for avahi-daemon) or native (built-in responder, announces only while running) (default avahi)"`
+	MDNSTimeout        time.Duration
+	MDNSTimeoutSetter  func(int) `long:"mdns_timeout" description:"how long each native mDNS browse waits for responses (default 2s)"`
 	PollInterval       time.Duration
 	PollIntervalSetter func(int) `long:"poll_interval" description:"polling interval when trying to find peers (default 1s)"`
 	MaxLoops           int       `long:"max_loops" description:"maximum number of loops to poll before writing etcd conf (default 10)"`
+	Expect             int       `long:"expect" description:"expected cluster size; wait for this many nodes, then all write the same member set (default 0, off)"`
+	ExpectWait         time.Duration
+	ExpectWaitSetter   func(int) `long:"expect_wait" description:"seconds to wait for --expect nodes before founding with those seen (default 300)"`
+	ClusterName        string    `long:"cluster_name" description:"only cluster with peers publishing the same cluster name, so that several clusters can share a LAN"`
+	JoinToken          string    `long:"join_token" description:"only cluster with peers configured with the same token; a hash of it is published"`
+	JoinSecret         string    `long:"join_secret" description:"shared secret; announcements are signed with it and peers whose signature fails are ignored"`
+	PKI                bool      `long:"pki" description:"founder creates a cluster CA and issues TLS certificates to the other nodes, which then hold the CA too; requires --join_secret, and --daemon, --expect or --handshake"`
+	PKIPort            int       `long:"pki_port" description:"port the founder answers certificate requests on (default 7013)"`
+	TLSDir             string    `long:"tls_dir" description:"where --pki keeps the CA, certificate and key (default /etc/etcd/tls)"`
+	PKILinger          time.Duration
+	PKILingerSetter    func(int) `long:"pki_linger" description:"seconds a founder without --daemon waits after writing its conf for the members it founded with to request certificates, and joiners wait for a CA (default 300)"`
+	ProbeTimeout       time.Duration
+	ProbeTimeoutSetter func(int) `long:"probe_timeout" description:"seconds before an HTTP request to a peer or discovery URL is abandoned (default 5)"`
+	ProbeWorkers       int       `long:"probe_workers" description:"number of peers probed at once (default 8)"`
+	ProbeCAFile        string    `long:"probe_ca_file" description:"CA to verify peers and the discovery URL with (default --etcd_ca_file)"`
+	ProbeCertFile      string    `long:"probe_cert_file" description:"client certificate to present when probing (default --etcd_cert_file)"`
+	ProbeKeyFile       string    `long:"probe_key_file" description:"key for --probe_cert_file"`
+	EchoPort           int       `long:"echo_port" description:"TCP port that tells peers the address they connected from, so peers beyond a router can check the return path; 0 accepts only directly connected peers (default 7014)"`
+	Election           string    `long:"election" description:"how to choose the founding node: ip (lowest address), uuid (lowest name), priority (highest --priority), seed (first --seed) (default ip)"`
+	Priority           int       `long:"priority" description:"election priority for --election priority; the highest founds (default 0)"`
+	Handshake          bool      `long:"handshake" description:"founder proposes the member set over UDP and waits for every member to acknowledge before writing conf; needs mdns, avahi or udp discovery"`
+	HandshakePort      int       `long:"handshake_port" description:"UDP port for the founding handshake (default 7012)"`
+	ProposalWait       time.Duration
+	ProposalWaitSetter func(int) `long:"handshake_wait" description:"seconds to wait for the founding handshake to complete (default 30)"`
 	AvahiConfPath      string    `long:"avahi_conf_path" description:"where to write avahi service definition to (default /etc/avahi/services/etcd.service)"`
+	Discovery          string    `long:"discovery" description:"comma separated discovery backends to poll, in order: url, mdns, avahi, udp, srv, static (default 'url,mdns')"`
+	UDPPort            int       `long:"udp_port" description:"port for UDP broadcast discovery (default 7011)"`
+	SRVName            string    `long:"srv_name" description:"SRV record name for DNS discovery (default '_etcd-server._tcp')"`
+	SRVDomain          string    `long:"srv_domain" description:"domain for DNS SRV discovery"`
+	SRVResolver        string    `long:"srv_resolver" description:"DNS server host[:port] for SRV discovery (default system resolver)"`
+	Seeds              []string  `long:"seed" description:"seed peer host[:port] to probe; comma separated or repeated. Implies the static backend"`
+	PeersFile          string    `long:"peers_file" description:"file of seed peers, one host[:port] per line, re-read every poll. Implies the static backend"`
+	Daemon             bool      `long:"daemon" description:"keep watching peers after the conf is written, reporting peers that appear, disappear or change"`
+	DaemonRewrite      bool      `long:"daemon_rewrite" description:"in --daemon mode, rewrite the etcd and fleet conf when the set of server peers changes"`
+	PeerExpiry         time.Duration
+	PeerExpirySetter   func(int) `long:"peer_expiry" description:"in --daemon mode, seconds a peer address may go unseen before it is gone (default 30)"`
+	EventCommand       string    `long:"peer_event_command" description:"in --daemon mode, shell command run for each peer event, with PEER_EVENT, PEER_NAME, PEER_ROLE, PEER_ADDRS and PEER_OLD_ADDRS set"`
+	Reap               bool      `long:"reap" description:"in --daemon mode, have the etcd leader remove members that have been absent from discovery and unhealthy for --reap_grace, while a quorum is healthy; needs etcd 2+"`
+	ReapGrace          time.Duration
+	ReapGraceSetter    func(int) `long:"reap_grace" description:"seconds a member must be gone before it is removed (default 600)"`
+	ReapDryRun         bool      `long:"reap_dry_run" description:"only report the members --reap would remove"`
 	Debug              bool      `long:"debug" description:"Debug mode"`
 }
 
@@ -70,14 +114,69 @@ func (c *Config) load(argsin []string) ([]string, error) {
 	c.MDNSInstance = c.UUID
 	c.MDNSService = "_scriptrock_etcd._tcp"
 	c.MDNSDomain = "local"
+	c.MDNSBrowser = ""
+	c.MDNSPublisher = "avahi"
+	c.MDNSTimeout = 2 * time.Second
 	c.PollInterval = 1 * time.Second
 	c.MaxLoops = 10
+	c.Expect = 0
+	c.ExpectWait = 300 * time.Second
+	c.ClusterName = ""
+	c.JoinToken = ""
+	c.JoinSecret = ""
+	c.PKI = false
+	c.PKIPort = 7013
+	c.TLSDir = "/etc/etcd/tls"
+	c.PKILinger = 300 * time.Second
+	c.ProbeTimeout = 5 * time.Second
+	c.ProbeWorkers = 8
+	c.EchoPort = 7014
+	c.Election = "ip"
+	c.Priority = 0
+	c.Handshake = false
+	c.HandshakePort = 7012
+	c.ProposalWait = 30 * time.Second
 	c.AvahiConfPath = "/etc/avahi/services/etcd.service"
+	c.Discovery = "url,mdns"
+	c.UDPPort = 7011
+	c.SRVName = "_etcd-server._tcp"
+	c.SRVDomain = ""
+	c.SRVResolver = ""
+	c.Seeds = make([]string, 0)
+	c.PeersFile = ""
+	c.Daemon = false
+	c.DaemonRewrite = false
+	c.PeerExpiry = 30 * time.Second
+	c.EventCommand = ""
+	c.Reap = false
+	c.ReapGrace = 600 * time.Second
+	c.ReapDryRun = false
 	c.Debug = false
 
 	c.PollIntervalSetter = func(i int) {
 		c.PollInterval = time.Duration(i) * time.Second
 	}
+	c.MDNSTimeoutSetter = func(i int) {
+		c.MDNSTimeout = time.Duration(i) * time.Second
+	}
+	c.ExpectWaitSetter = func(i int) {
+		c.ExpectWait = time.Duration(i) * time.Second
+	}
+	c.ProposalWaitSetter = func(i int) {
+		c.ProposalWait = time.Duration(i) * time.Second
+	}
+	c.ProbeTimeoutSetter = func(i int) {
+		c.ProbeTimeout = time.Duration(i) * time.Second
+	}
+	c.PKILingerSetter = func(i int) {
+		c.PKILinger = time.Duration(i) * time.Second
+	}
+	c.PeerExpirySetter = func(i int) {
+		c.PeerExpiry = time.Duration(i) * time.Second
+	}
+	c.ReapGraceSetter = func(i int) {
+		c.ReapGrace = time.Duration(i) * time.Second
+	}
 	return go_flags.NewParser(c, go_flags.IgnoreUnknown).ParseArgs(argsin)
 }
 
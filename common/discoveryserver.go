@@ -0,0 +1,31 @@
+package common
+
+import (
+	go_flags "github.com/jessevdk/go-flags"
+)
+
+type DiscoveryServerConfig struct {
+	Listen   string `long:"listen" description:"address to serve the discovery API on (default ':8087')"`
+	StoreDir string `long:"store_dir" description:"directory holding one file per discovery token (default /var/lib/scriptrock_discovery)"`
+	BaseURL  string `long:"base_url" description:"URL prefix for tokens handed out by /new (default from the request Host header)"`
+	MaxWait  int    `long:"max_wait" description:"longest a wait=true request is held open, in seconds (default 300)"`
+}
+
+func (c *DiscoveryServerConfig) load(argsin []string) ([]string, error) {
+	// Set some defaults
+	c.Listen = ":8087"
+	c.StoreDir = "/var/lib/scriptrock_discovery"
+	c.BaseURL = ""
+	c.MaxWait = 300
+
+	// override defaults, incoming conf, env vars with command line arguments
+	argsout, err := go_flags.NewParser(c, go_flags.IgnoreUnknown).ParseArgs(argsin)
+
+	return argsout, err
+}
+
+func NewDiscoveryServerConfig(argsin []string) (*DiscoveryServerConfig, []string, error) {
+	c := new(DiscoveryServerConfig)
+	argsout, err := c.load(argsin)
+	return c, argsout, err
+}
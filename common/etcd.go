@@ -5,31 +5,54 @@ import (
 	go_flags "github.com/jessevdk/go-flags"
 	"io/ioutil"
 	"net"
+	"sort"
 	"strings"
 )
 
 type EtcdPeer struct {
-	Interface *net.Interface
-	LocalIP   net.IP
-	PeerIP    net.IP
-	PeerPort  int
+	Name       string // etcd name, which is the peer's UUID unless configured otherwise
+	Interface  *net.Interface
+	LocalIP    net.IP
+	PeerIP     net.IP
+	PeerPort   int
+	ClientPort int // the peer's own, which need not match ours
+	Priority   int // election priority published by the peer, if any
 }
 
 type EtcdConfig struct {
-	Name           string   `long:"etcd_name" description:"etcd machine name, must be unique within cluster. Default is UUID"`
-	ConfPath       string   `long:"etcd_conf" description:"etcd conf path (default /etc/etcd/etcd.conf)"`
-	ClientAddr     string   `long:"etcd_client_addr" description:"etcd client address (default from $private_ipv4, or peers)"`
-	ClientBindAddr string   `long:"etcd_client_bind_addr" description:"etcd client bind address (default 0.0.0.0)"`
-	ClientPort     int      `long:"etcd_client_port" description:"etcd client port (default 4001)"`
-	PeerAddr       string   `long:"etcd_peer_addr" description:"etcd peer address (default 0.0.0.0)"`
-	PeerBindAddr   string   `long:"etcd_peer_bind_addr" description:"etcd peer bind address (default 0.0.0.0)"`
-	PeerPort       int      `long:"etcd_peer_port" description:"etcd peer port (default 7001)"`
-	DiscoveryURL   string   `long:"etcd_discovery_url" description:"etcd peer discovery url"`
-	Peers          []string // found through mDNS etc
+	Name           string            `long:"etcd_name" description:"etcd machine name, must be unique within cluster. Default is UUID"`
+	ConfPath       string            `long:"etcd_conf" description:"etcd conf path (default /etc/etcd/etcd.conf)"`
+	ClientAddr     string            `long:"etcd_client_addr" description:"etcd client address (default from $private_ipv4, or peers)"`
+	ClientBindAddr string            `long:"etcd_client_bind_addr" description:"etcd client bind address (default 0.0.0.0, or :: for an IPv6 client address)"`
+	ClientPort     int               `long:"etcd_client_port" description:"etcd client port (default 4001)"`
+	PeerAddr       string            `long:"etcd_peer_addr" description:"etcd peer address (default 0.0.0.0)"`
+	PeerBindAddr   string            `long:"etcd_peer_bind_addr" description:"etcd peer bind address (default 0.0.0.0, or :: for an IPv6 peer address)"`
+	PeerPort       int               `long:"etcd_peer_port" description:"etcd peer port (default 7001)"`
+	DiscoveryURL   string            `long:"etcd_discovery_url" description:"etcd peer discovery url"`
+	DiscoveryWait  int               `long:"etcd_discovery_wait" description:"seconds to wait for the discovery url to reach its expected cluster size (default 300)"`
+	ConfFormat     string            `long:"etcd_conf_format" description:"etcd conf format: toml (etcd 0.4), env (etcd 2/3 environment file) or yaml (etcd 3 config file) (default toml)"`
+	CAFile         string            `long:"etcd_ca_file" description:"CA certificate etcd trusts for peers and clients; enables TLS"`
+	CertFile       string            `long:"etcd_cert_file" description:"certificate etcd serves and presents to peers; enables TLS"`
+	KeyFile        string            `long:"etcd_key_file" description:"key for --etcd_cert_file"`
+	Peers          []string          // found through mDNS etc
+	InitialCluster map[string]string // etcd name -> peer URL, when membership is known up front
+	UnstartedPeers []string          // peer URLs of members added to a running cluster but not started, so without a name
+	ClusterState   string            // new or existing; derived from ServerPeers if empty
+	ClusterID      string            // reported by the members API when joining
+	Founder        string            // name of the founding node, when the member set was agreed up front
 	ServerPeers    map[string]EtcdPeer
 	BootingPeers   map[string]EtcdPeer
-	AddrSource     string `long:"addr_from" description:"where to obtain addr & peer_addr from. Options: private_ipv4, public_ipv4, or heuristics"`
+	AddrSource     string   `long:"addr_from" description:"comma separated sources to obtain addr & peer_addr from, tried in order: a file path, coreos_private, coreos_public (/etc/environment), ec2_private, ec2_public, gce_private, gce_public, openstack_private, openstack_public, digitalocean_private, digitalocean_public; heuristics if none verifies (default /etc/private_ipv4)"`
+	AddrFamily     string   `long:"addr_family" description:"address family for peers and our own address: ipv4, ipv6, prefer_ipv4 or prefer_ipv6 (default prefer_ipv4)"`
+	IfaceInclude   []string `long:"iface_include" description:"interface name globs our address may be taken from, comma separated or repeated (default any non-virtual)"`
+	IfaceExclude   []string `long:"iface_exclude" description:"interface name globs never to take our address from or reach peers through, e.g. docker0,veth*,flannel*"`
+	AllowCIDRs     []string `long:"allow_cidr" description:"only take our address from these CIDRs, comma separated or repeated"`
+	DenyCIDRs      []string `long:"deny_cidr" description:"never take our address from these CIDRs, comma separated or repeated"`
+	DefaultRoute   bool     `long:"prefer_default_route" description:"prefer addresses on the interface of the default route, from /proc/net/route"`
+	AddrRule       string   // which rule chose ClientAddr, for the address report
 	Interface      *net.Interface
+	allowNets      []*net.IPNet
+	denyNets       []*net.IPNet
 }
 
 func (c *EtcdConfig) load(argsin []string, name string) ([]string, error) {
@@ -39,14 +62,24 @@ func (c *EtcdConfig) load(argsin []string, name string) ([]string, error) {
 	c.ClientAddr = "" // there is much more complex logic around this elsewhere
 	c.ClientPort = 4001
 	c.PeerAddr = ""
-	c.ClientBindAddr = "0.0.0.0"
-	c.PeerBindAddr = "0.0.0.0"
+	c.ClientBindAddr = "" // wildcard in the same family as the client address
+	c.PeerBindAddr = ""
 	c.PeerPort = 7001
 	c.DiscoveryURL = ""
+	c.DiscoveryWait = 300
+	c.ConfFormat = "toml"
 	c.Peers = make([]string, 0)
+	c.InitialCluster = make(map[string]string)
+	c.ClusterState = ""
 	c.ServerPeers = make(map[string]EtcdPeer)
 	c.BootingPeers = make(map[string]EtcdPeer)
 	c.AddrSource = "/etc/private_ipv4"
+	c.AddrFamily = AddrFamilyPreferIPv4
+	c.IfaceInclude = make([]string, 0)
+	c.IfaceExclude = make([]string, 0)
+	c.AllowCIDRs = make([]string, 0)
+	c.DenyCIDRs = make([]string, 0)
+	c.DefaultRoute = false
 
 	// TODO FIXME one day, load some from an incoming config file
 	// TODO FIXME one day, override defaults and incoming conf with environment variables
@@ -56,36 +89,40 @@ func (c *EtcdConfig) load(argsin []string, name string) ([]string, error) {
 
 	// Warning: go_flags parser will set pointer types to not nil.... bad.
 	c.Interface = nil
+	if err == nil {
+		err = c.checkAddrFamily()
+	}
+	if err == nil {
+		err = c.loadAddrPolicy()
+	}
 
-	// load client address from /etc/ if present
+	// load client address from /etc/ or the cloud metadata service if present
 	if true && c.ClientAddr == "" {
-		if useAddr, err := ioutil.ReadFile(c.AddrSource); err == nil {
-			if ip := net.ParseIP(strings.TrimSpace(string(useAddr))); ip == nil {
-				fmt.Printf("Invalid IP address found in '%s'\n", c.AddrSource)
-			} else {
-				c.verifyIP(ip, c.AddrSource)
-			}
-		}
+		c.loadAddrSources()
 	}
 
 	return argsout, err
 }
 
-func (c *EtcdConfig) AddServerPeer(iface *net.Interface, localIP net.IP, peerIP net.IP, peerPort int) {
+func (c *EtcdConfig) AddServerPeer(name string, iface *net.Interface, localIP net.IP, peerIP net.IP, peerPort int, clientPort int) {
 	c.ServerPeers[peerIP.String()] = EtcdPeer{
-		Interface: iface,
-		LocalIP:   localIP,
-		PeerIP:    peerIP,
-		PeerPort:  peerPort,
+		Name:       name,
+		Interface:  iface,
+		LocalIP:    localIP,
+		PeerIP:     peerIP,
+		PeerPort:   peerPort,
+		ClientPort: clientPort,
 	}
 }
 
-func (c *EtcdConfig) AddBootingPeer(iface *net.Interface, localIP net.IP, peerIP net.IP, peerPort int) {
+func (c *EtcdConfig) AddBootingPeer(name string, iface *net.Interface, localIP net.IP, peerIP net.IP, peerPort int, priority int) {
 	c.BootingPeers[peerIP.String()] = EtcdPeer{
+		Name:      name,
 		Interface: iface,
 		LocalIP:   localIP,
 		PeerIP:    peerIP,
 		PeerPort:  peerPort,
+		Priority:  priority,
 	}
 }
 
@@ -96,7 +133,9 @@ func (c *EtcdConfig) verifyIP(ip net.IP, source string) {
 		fmt.Printf("%s\n", err.Error())
 	} else if !ip.Equal(ipverify) {
 		fmt.Printf("IP address on interface %s: %s does not match ip from %s: %s\n",
-			iface.Name, ipverify, c.AddrSource, ip)
+			iface.Name, ipverify, source, ip)
+	} else if err := c.CheckAddrPolicy(iface, ip); err != nil {
+		fmt.Printf("IP '%s' from '%s' not used: %s\n", ip.String(), source, err.Error())
 	} else {
 		fmt.Printf("IP '%s' verified, on interface '%s' net '%s'\n",
 			ip.String(), iface.Name, ip_net.String())
@@ -112,6 +151,7 @@ func (c *EtcdConfig) verifyIP(ip net.IP, source string) {
 		}
 		if set {
 			c.Interface = iface
+			c.AddrRule = fmt.Sprintf("address from '%s'", source)
 		}
 	}
 }
@@ -120,78 +160,158 @@ func IsIPv4(ip net.IP) bool {
 	return ip.DefaultMask() != nil
 }
 
-func (c *EtcdConfig) setupAddresses() {
-	// Now that all load sources have been tested; set up local addresses for etcd config
+// addrCandidate is an address we could use as our own, and the rule that proposes it
+type addrCandidate struct {
+	iface *net.Interface
+	ip    net.IP
+	rule  string
+}
 
-	// If a peer was found, use our local address based on that
-	if c.ClientAddr == "" {
-		for _, v := range c.ServerPeers {
-			c.ClientAddr = v.LocalIP.String()
-			fmt.Printf("setupAddresses: heuristic client address from server peer: %s\n", c.ClientAddr)
-			break
+// peerAddrCandidates are our addresses facing the given peers, in address order
+func peerAddrCandidates(kind string, peers map[string]EtcdPeer) []addrCandidate {
+	keys := make([]string, 0, len(peers))
+	for k, _ := range peers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	candidates := make([]addrCandidate, 0, len(keys))
+	for _, k := range keys {
+		p := peers[k]
+		if p.LocalIP == nil {
+			continue
 		}
+		rule := fmt.Sprintf("%s '%s' (%s)", kind, p.Name, p.PeerIP.String())
+		candidates = append(candidates, addrCandidate{iface: p.Interface, ip: p.LocalIP, rule: rule})
 	}
+	return candidates
+}
 
-	// Otherwise use booting peer; we may be the first to boot
-	if c.ClientAddr == "" {
-		for _, v := range c.BootingPeers {
-			c.ClientAddr = v.LocalIP.String()
-			fmt.Printf("setupAddresses: heuristic client address from booting peer: %s\n", c.ClientAddr)
-			break
-		}
+// interfaceAddrCandidates are the addresses of our non-virtual interfaces, last interface first,
+// in --addr_family order. Link-local addresses are no use to peers on other links.
+func (c *EtcdConfig) interfaceAddrCandidates() []addrCandidate {
+	ipv4 := make([]addrCandidate, 0)
+	ipv6 := make([]addrCandidate, 0)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		fmt.Printf("SetupAddresses: Error getting network interfaces: '%s'\n", err.Error())
+		return ipv4
 	}
+	for i := len(ifaces) - 1; i >= 0; i-- {
+		iface := ifaces[i]
+		if (iface.Flags & net.FlagLoopback) != 0 {
+			continue
+		}
+		if (iface.Flags & net.FlagUp) == 0 {
+			continue
+		}
+		if (iface.Flags & net.FlagMulticast) == 0 {
+			continue
+		}
+		if InterfaceIsVirtual(&iface) && !c.ifaceIncluded(&iface) {
+			continue
+		}
 
-	// Last resort; iterate over our interfaces and use the last non-virtual one (linux specific)
-	if c.ClientAddr == "" {
-		var lastIP net.IP = nil
-		if ifaces, err := net.Interfaces(); err != nil {
-			fmt.Printf("setupAddresses: Error getting network interfaces: '%s'\n", err.Error())
+		if iface_addrs, err := iface.Addrs(); err != nil {
+			fmt.Printf("SetupAddresses: Error getting interface addresses: %s\n", err.Error())
 		} else {
-			for _, iface := range ifaces {
-				if (iface.Flags & net.FlagLoopback) != 0 {
-					continue
-				}
-				if (iface.Flags & net.FlagUp) == 0 {
-					continue
-				}
-				if (iface.Flags & net.FlagMulticast) == 0 {
-					continue
-				}
-				if InterfaceIsVirtual(&iface) {
-					continue
+			for _, iface_addr := range iface_addrs {
+				ipstr := iface_addr.String()
+				ip, _, err := net.ParseCIDR(ipstr)
+				if err != nil {
+					fmt.Printf("Error parsing local address '%s': %s\n",
+						ipstr, err.Error())
+				} else if IsIPv4(ip) {
+					ipv4 = append(ipv4, addrCandidate{iface: &ifaces[i], ip: ip, rule: "interface " + iface.Name})
+				} else if ip.To4() == nil && !ip.IsLinkLocalUnicast() {
+					ipv6 = append(ipv6, addrCandidate{iface: &ifaces[i], ip: ip, rule: "interface " + iface.Name})
 				}
+			}
+		}
+	}
+	switch c.AddrFamily {
+	case AddrFamilyIPv4:
+		return ipv4
+	case AddrFamilyIPv6:
+		return ipv6
+	case AddrFamilyPreferIPv6:
+		return append(ipv6, ipv4...)
+	default:
+		return append(ipv4, ipv6...)
+	}
+}
 
-				if iface_addrs, err := iface.Addrs(); err != nil {
-					fmt.Errorf("setupAddresses: Error getting interface addresses: %s\n", err.Error())
-				} else {
-					for _, iface_addr := range iface_addrs {
-						ipstr := iface_addr.String()
-						ip, _, err := net.ParseCIDR(ipstr)
-						if err != nil {
-							fmt.Printf("Error parsing local address '%s': %s\n",
-								ipstr, err.Error())
-						} else {
-							// Use an IPv4 address only
-							if IsIPv4(ip) {
-								lastIP = ip
-							}
-						}
-					}
+// chooseAddr takes the first candidate the policy allows, from the first tier that has one.
+// With --prefer_default_route, a candidate on a default route interface wins within its tier.
+func (c *EtcdConfig) chooseAddr(tiers [][]addrCandidate) *addrCandidate {
+	defaultRoutes := []string{}
+	if c.DefaultRoute {
+		defaultRoutes = DefaultRouteInterfaces()
+	}
+	for _, tier := range tiers {
+		var first *addrCandidate
+		for i := range tier {
+			cand := &tier[i]
+			if err := c.CheckAddrPolicy(cand.iface, cand.ip); err != nil {
+				fmt.Printf("SetupAddresses: not using %s from %s: %s\n", cand.ip.String(), cand.rule, err.Error())
+				continue
+			}
+			if cand.iface != nil {
+				if hasString(defaultRoutes, cand.iface.Name) {
+					cand.rule += ", on the default route interface"
+					return cand
 				}
 			}
+			if first == nil {
+				first = cand
+			}
 		}
-		if lastIP != nil {
-			c.ClientAddr = lastIP.String()
-			fmt.Printf("setupAddresses: heuristic client address from last network interface: %s\n", c.ClientAddr)
+		if first != nil {
+			return first
+		}
+	}
+	return nil
+}
+
+func (c *EtcdConfig) SetupAddresses() {
+	// Now that all load sources have been tested; set up local addresses for etcd config
+	if c.ClientAddr != "" && c.AddrRule == "" {
+		c.AddrRule = "--etcd_client_addr"
+	}
+
+	// If a peer was found, use our local address based on that. Otherwise use a booting peer;
+	// we may be the first to boot. Last resort is our own interfaces.
+	if c.ClientAddr == "" {
+		chosen := c.chooseAddr([][]addrCandidate{
+			peerAddrCandidates("server peer", c.ServerPeers),
+			peerAddrCandidates("booting peer", c.BootingPeers),
+			c.interfaceAddrCandidates(),
+		})
+		if chosen != nil {
+			c.ClientAddr = ZonedHost(chosen.ip, chosen.zone())
+			c.AddrRule = chosen.rule
 		} else {
-			c.ClientAddr = "127.0.0.1"
-			fmt.Printf("setupAddresses: cannot find any valid addresses; using loopback interface: %s\n", c.ClientAddr)
+			c.ClientAddr = c.loopbackFor()
+			c.AddrRule = "no usable address; loopback"
 		}
+		fmt.Printf("SetupAddresses: client address %s chosen by %s\n", c.ClientAddr, c.AddrRule)
 	}
 
 	if c.PeerAddr == "" {
 		c.PeerAddr = c.ClientAddr
 	}
+	if c.ClientBindAddr == "" {
+		c.ClientBindAddr = unspecifiedFor(c.ClientAddr)
+	}
+	if c.PeerBindAddr == "" {
+		c.PeerBindAddr = unspecifiedFor(c.PeerAddr)
+	}
+}
+
+func (a *addrCandidate) zone() string {
+	if a.iface == nil {
+		return ""
+	}
+	return a.iface.Name
 }
 
 func NewEtcdConfig(argsin []string, name string) (*EtcdConfig, []string, error) {
@@ -201,33 +321,60 @@ func NewEtcdConfig(argsin []string, name string) (*EtcdConfig, []string, error)
 }
 
 func (cfg *EtcdConfig) WriteFile() {
-	cfg.setupAddresses()
+	cfg.SetupAddresses()
+	fmt.Printf("Address report: client %s peer %s, chosen by %s\n", cfg.ClientAddr, cfg.PeerAddr, cfg.AddrRule)
 
+	conf := ""
+	switch cfg.ConfFormat {
+	case "env":
+		conf = cfg.envConf()
+	case "yaml":
+		conf = cfg.yamlConf()
+	default:
+		conf = cfg.tomlConf()
+	}
+
+	fmt.Printf("Writing etcd conf file to '%s'\n", cfg.ConfPath)
+	if err := ioutil.WriteFile(cfg.ConfPath, []byte(conf), 0644); err != nil {
+		fmt.Printf("Could not write conf file '%s': %s\n", cfg.ConfPath, err.Error())
+	}
+}
+
+func (cfg *EtcdConfig) tomlConf() string {
 	peers := make([]string, 0)
 	if cfg.DiscoveryURL == "" {
+		keys := make([]string, 0, len(cfg.ServerPeers))
 		for k, _ := range cfg.ServerPeers {
-			peers = append(peers, fmt.Sprintf("\"%s:%d\"", k, cfg.PeerPort))
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := cfg.ServerPeers[k]
+			peers = append(peers, fmt.Sprintf("\"%s\"", HostPort(p.PeerIP, p.Zone(), cfg.PeerPort)))
+		}
+		for _, p := range cfg.Peers {
+			peers = append(peers, fmt.Sprintf("\"%s\"", p))
 		}
 	}
 
 	// wrap each peer in quotes
-	conf := fmt.Sprintf(
+	return fmt.Sprintf(
 		`
 #
 # Generated by ScriptRock Config init
 #
 name = "%s"
-addr = "%s:%d"
-bind_addr = "%s:%d"
-#ca_file = ""
-#cert_file = ""
+addr = "%s"
+bind_addr = "%s"
+%s
+%s
 #cors = []
 #cpu_profile_file = ""
 #data_dir = "."
 discovery = "%s"
 #http_read_timeout = 10.0
 #http_write_timeout = 10.0
-#key_file = ""
+%s
 peers = [%s]
 #peers_file = ""
 #max_cluster_size = 9
@@ -238,11 +385,11 @@ peers = [%s]
 #very_verbose = false
 #
 [peer]
-addr = "%s:%d"
-bind_addr = "%s:%d"
-#ca_file = ""
-#cert_file = ""
-#key_file = ""
+addr = "%s"
+bind_addr = "%s"
+%s
+%s
+%s
 #
 #[cluster]
 #active_size = 9
@@ -250,16 +397,25 @@ bind_addr = "%s:%d"
 #sync_interval = 5.0
 #
 `,
-		cfg.Name,                       // name
-		cfg.ClientAddr, cfg.ClientPort, // addr
-		cfg.ClientBindAddr, cfg.ClientPort, // bind_addr
-		cfg.DiscoveryURL,           // discovery
-		strings.Join(peers, ","),   // peers
-		cfg.PeerAddr, cfg.PeerPort, // peer_addr
-		cfg.PeerBindAddr, cfg.PeerPort) // peer_bind_addr
+		cfg.Name, // name
+		joinHostPort(cfg.ClientAddr, cfg.ClientPort),     // addr
+		joinHostPort(cfg.ClientBindAddr, cfg.ClientPort), // bind_addr
+		tomlSetting("ca_file", cfg.CAFile),
+		tomlSetting("cert_file", cfg.CertFile),
+		cfg.DiscoveryURL, // discovery
+		tomlSetting("key_file", cfg.KeyFile),
+		strings.Join(peers, ","),                     // peers
+		joinHostPort(cfg.PeerAddr, cfg.PeerPort),     // peer_addr
+		joinHostPort(cfg.PeerBindAddr, cfg.PeerPort), // peer_bind_addr
+		tomlSetting("ca_file", cfg.CAFile),
+		tomlSetting("cert_file", cfg.CertFile),
+		tomlSetting("key_file", cfg.KeyFile))
+}
 
-	fmt.Printf("Writing etcd conf file to '%s'\n", cfg.ConfPath)
-	if err := ioutil.WriteFile(cfg.ConfPath, []byte(conf), 0644); err != nil {
-		fmt.Printf("Could not write conf file '%s': %s\n", cfg.ConfPath, err.Error())
+// tomlSetting writes a string setting, or leaves it commented out if empty
+func tomlSetting(key string, value string) string {
+	if value == "" {
+		return fmt.Sprintf("#%s = \"\"", key)
 	}
+	return fmt.Sprintf("%s = \"%s\"", key, value)
 }
@@ -0,0 +1,165 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Output for etcd 2.x/3.x, which is configured with an initial cluster rather than a peers list
+
+// Scheme is https once etcd has a certificate; the whole cluster is expected to agree
+func (cfg *EtcdConfig) Scheme() string {
+	if cfg.CertFile != "" {
+		return "https"
+	}
+	return "http"
+}
+
+func (cfg *EtcdConfig) PeerURL() string {
+	return fmt.Sprintf("%s://%s", cfg.Scheme(), urlHostPort(cfg.PeerAddr, cfg.PeerPort))
+}
+
+func (cfg *EtcdConfig) ClientURL() string {
+	return fmt.Sprintf("%s://%s", cfg.Scheme(), urlHostPort(cfg.ClientAddr, cfg.ClientPort))
+}
+
+func (cfg *EtcdConfig) listenPeerURL() string {
+	return fmt.Sprintf("%s://%s", cfg.Scheme(), urlHostPort(cfg.PeerBindAddr, cfg.PeerPort))
+}
+
+func (cfg *EtcdConfig) listenClientURL() string {
+	return fmt.Sprintf("%s://%s", cfg.Scheme(), urlHostPort(cfg.ClientBindAddr, cfg.ClientPort))
+}
+
+// initialCluster returns the name=peerURL list for etcd. Unless membership was established up
+// front, it is us plus any running server peers we are joining.
+func (cfg *EtcdConfig) initialCluster() string {
+	members := make(map[string]string)
+	for name, peerURL := range cfg.InitialCluster {
+		members[name] = peerURL
+	}
+	if len(members) == 0 {
+		for _, p := range cfg.ServerPeers {
+			members[p.Name] = fmt.Sprintf("%s://%s", cfg.Scheme(), URLHost(p.PeerIP, p.Zone(), p.PeerPort))
+		}
+	}
+	members[cfg.Name] = cfg.PeerURL()
+
+	names := make([]string, 0, len(members))
+	for name, _ := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cluster := make([]string, 0, len(names))
+	for _, name := range names {
+		cluster = append(cluster, fmt.Sprintf("%s=%s", name, members[name]))
+	}
+	// as etcdctl member add does; joining an existing cluster, etcd checks that every member is listed
+	for _, peerURL := range cfg.UnstartedPeers {
+		cluster = append(cluster, "="+peerURL)
+	}
+	return strings.Join(cluster, ",")
+}
+
+// initialClusterState is new when we found the cluster, existing when joining a running server
+func (cfg *EtcdConfig) initialClusterState() string {
+	if cfg.ClusterState != "" {
+		return cfg.ClusterState
+	}
+	if len(cfg.ServerPeers) > 0 {
+		return "existing"
+	}
+	return "new"
+}
+
+func (cfg *EtcdConfig) envConf() string {
+	discovery := ""
+	if cfg.DiscoveryURL != "" {
+		// etcd does its own discovery; initial cluster must not be given as well
+		discovery = fmt.Sprintf("ETCD_DISCOVERY=\"%s\"\n", cfg.DiscoveryURL)
+	} else {
+		discovery = fmt.Sprintf("ETCD_INITIAL_CLUSTER=\"%s\"\nETCD_INITIAL_CLUSTER_STATE=\"%s\"\n",
+			cfg.initialCluster(), cfg.initialClusterState())
+	}
+	return fmt.Sprintf(
+		`#
+# Generated by ScriptRock Config init
+#
+ETCD_NAME="%s"
+ETCD_LISTEN_PEER_URLS="%s"
+ETCD_LISTEN_CLIENT_URLS="%s"
+ETCD_INITIAL_ADVERTISE_PEER_URLS="%s"
+ETCD_ADVERTISE_CLIENT_URLS="%s"
+%s%s`,
+		cfg.Name,
+		cfg.listenPeerURL(),
+		cfg.listenClientURL(),
+		cfg.PeerURL(),
+		cfg.ClientURL(),
+		discovery,
+		cfg.envTLS())
+}
+
+// envTLS requires certificates between peers. Clients are not required to present one, so that
+// booting nodes can still tell the server is up.
+func (cfg *EtcdConfig) envTLS() string {
+	if cfg.CertFile == "" {
+		return ""
+	}
+	return fmt.Sprintf(`ETCD_CERT_FILE="%s"
+ETCD_KEY_FILE="%s"
+ETCD_TRUSTED_CA_FILE="%s"
+ETCD_PEER_CERT_FILE="%s"
+ETCD_PEER_KEY_FILE="%s"
+ETCD_PEER_TRUSTED_CA_FILE="%s"
+ETCD_PEER_CLIENT_CERT_AUTH="true"
+`,
+		cfg.CertFile, cfg.KeyFile, cfg.CAFile,
+		cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+}
+
+func (cfg *EtcdConfig) yamlConf() string {
+	discovery := ""
+	if cfg.DiscoveryURL != "" {
+		discovery = fmt.Sprintf("discovery: '%s'\n", cfg.DiscoveryURL)
+	} else {
+		discovery = fmt.Sprintf("initial-cluster: '%s'\ninitial-cluster-state: '%s'\n",
+			cfg.initialCluster(), cfg.initialClusterState())
+	}
+	return fmt.Sprintf(
+		`#
+# Generated by ScriptRock Config init
+#
+name: '%s'
+listen-peer-urls: '%s'
+listen-client-urls: '%s'
+initial-advertise-peer-urls: '%s'
+advertise-client-urls: '%s'
+%s%s`,
+		cfg.Name,
+		cfg.listenPeerURL(),
+		cfg.listenClientURL(),
+		cfg.PeerURL(),
+		cfg.ClientURL(),
+		discovery,
+		cfg.yamlTLS())
+}
+
+func (cfg *EtcdConfig) yamlTLS() string {
+	if cfg.CertFile == "" {
+		return ""
+	}
+	return fmt.Sprintf(`client-transport-security:
+  cert-file: '%s'
+  key-file: '%s'
+  trusted-ca-file: '%s'
+peer-transport-security:
+  cert-file: '%s'
+  key-file: '%s'
+  trusted-ca-file: '%s'
+  client-cert-auth: true
+`,
+		cfg.CertFile, cfg.KeyFile, cfg.CAFile,
+		cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+}
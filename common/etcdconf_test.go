@@ -0,0 +1,118 @@
+package common
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func newConfTestConfig() *EtcdConfig {
+	return &EtcdConfig{
+		Name:           "self",
+		ClientAddr:     "10.0.0.9",
+		PeerAddr:       "10.0.0.9",
+		ClientBindAddr: "0.0.0.0",
+		PeerBindAddr:   "0.0.0.0",
+		ClientPort:     2379,
+		PeerPort:       2380,
+		InitialCluster: make(map[string]string),
+		ServerPeers:    make(map[string]EtcdPeer),
+		BootingPeers:   make(map[string]EtcdPeer),
+	}
+}
+
+func TestEtcdConf(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(c *EtcdConfig)
+		env   []string
+		yaml  []string
+	}{
+		{
+			name:  "alone",
+			setup: func(c *EtcdConfig) {},
+			env: []string{
+				`ETCD_NAME="self"`,
+				`ETCD_LISTEN_PEER_URLS="http://0.0.0.0:2380"`,
+				`ETCD_ADVERTISE_CLIENT_URLS="http://10.0.0.9:2379"`,
+				`ETCD_INITIAL_CLUSTER="self=http://10.0.0.9:2380"`,
+				`ETCD_INITIAL_CLUSTER_STATE="new"`,
+			},
+			yaml: []string{
+				`name: 'self'`,
+				`initial-advertise-peer-urls: 'http://10.0.0.9:2380'`,
+				`listen-client-urls: 'http://0.0.0.0:2379'`,
+				`initial-cluster: 'self=http://10.0.0.9:2380'`,
+				`initial-cluster-state: 'new'`,
+			},
+		},
+		{
+			name: "founding members",
+			setup: func(c *EtcdConfig) {
+				c.InitialCluster["b"] = "http://10.0.0.2:2380"
+				c.InitialCluster["a"] = "http://10.0.0.1:2380"
+			},
+			env:  []string{`ETCD_INITIAL_CLUSTER="a=http://10.0.0.1:2380,b=http://10.0.0.2:2380,self=http://10.0.0.9:2380"`, `ETCD_INITIAL_CLUSTER_STATE="new"`},
+			yaml: []string{`initial-cluster: 'a=http://10.0.0.1:2380,b=http://10.0.0.2:2380,self=http://10.0.0.9:2380'`, `initial-cluster-state: 'new'`},
+		},
+		{
+			name: "joining a server",
+			setup: func(c *EtcdConfig) {
+				c.ServerPeers["10.0.0.3"] = EtcdPeer{Name: "c", PeerIP: net.ParseIP("10.0.0.3"), PeerPort: 2380}
+			},
+			env:  []string{`ETCD_INITIAL_CLUSTER="c=http://10.0.0.3:2380,self=http://10.0.0.9:2380"`, `ETCD_INITIAL_CLUSTER_STATE="existing"`},
+			yaml: []string{`initial-cluster: 'c=http://10.0.0.3:2380,self=http://10.0.0.9:2380'`, `initial-cluster-state: 'existing'`},
+		},
+		{
+			name: "joined with a member not started",
+			setup: func(c *EtcdConfig) {
+				c.InitialCluster["c"] = "http://10.0.0.3:2380"
+				c.UnstartedPeers = []string{"http://10.0.0.4:2380"}
+				c.ClusterState = "existing"
+			},
+			env:  []string{`ETCD_INITIAL_CLUSTER="c=http://10.0.0.3:2380,self=http://10.0.0.9:2380,=http://10.0.0.4:2380"`, `ETCD_INITIAL_CLUSTER_STATE="existing"`},
+			yaml: []string{`initial-cluster: 'c=http://10.0.0.3:2380,self=http://10.0.0.9:2380,=http://10.0.0.4:2380'`, `initial-cluster-state: 'existing'`},
+		},
+		{
+			name: "discovery url",
+			setup: func(c *EtcdConfig) {
+				c.DiscoveryURL = "https://discovery.etcd.io/token"
+				c.ServerPeers["10.0.0.3"] = EtcdPeer{Name: "c", PeerIP: net.ParseIP("10.0.0.3"), PeerPort: 2380}
+			},
+			env:  []string{`ETCD_DISCOVERY="https://discovery.etcd.io/token"`},
+			yaml: []string{`discovery: 'https://discovery.etcd.io/token'`},
+		},
+	}
+	for _, tt := range tests {
+		c := newConfTestConfig()
+		tt.setup(c)
+		for _, out := range []struct {
+			format string
+			conf   string
+			want   []string
+		}{
+			{format: "env", conf: c.envConf(), want: tt.env},
+			{format: "yaml", conf: c.yamlConf(), want: tt.yaml},
+		} {
+			lines := strings.Split(out.conf, "\n")
+			for _, want := range out.want {
+				if !containsLine(lines, want) {
+					t.Errorf("%s: %s conf has no line %s:\n%s", tt.name, out.format, want, out.conf)
+				}
+			}
+			// etcd refuses a discovery url and an initial cluster together
+			if c.DiscoveryURL != "" && (strings.Contains(out.conf, "INITIAL_CLUSTER=") || strings.Contains(out.conf, "initial-cluster:")) {
+				t.Errorf("%s: %s conf gives both a discovery url and an initial cluster", tt.name, out.format)
+			}
+		}
+	}
+}
+
+func containsLine(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
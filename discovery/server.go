@@ -0,0 +1,221 @@
+package discovery
+
+/*
+
+Self-hosted etcd discovery service
+
+-- Implements the discovery.etcd.io token API: create a token with an expected size, register members, list members.
+-- Tokens are kept in a local directory, one file per token.
+-- For firewalled sites that cannot reach discovery.etcd.io; point ETCD_DISCOVERY or /etc/etcd/discovery_url at it.
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ScriptRock/peerdiscovery/common"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const registryPrefix = "/_etcd/registry"
+
+type node struct {
+	Key           string  `json:"key"`
+	Value         string  `json:"value,omitempty"`
+	Dir           bool    `json:"dir,omitempty"`
+	Nodes         []*node `json:"nodes,omitempty"`
+	CreatedIndex  uint64  `json:"createdIndex"`
+	ModifiedIndex uint64  `json:"modifiedIndex"`
+}
+
+type response struct {
+	Action   string `json:"action"`
+	Node     *node  `json:"node"`
+	PrevNode *node  `json:"prevNode,omitempty"`
+}
+
+type errorResponse struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause"`
+	Index     uint64 `json:"index"`
+}
+
+// etcd v2 error codes used by discovery clients
+const (
+	errorKeyNotFound   = 100
+	errorNodeExist     = 105
+	errorRaftInternal  = 300
+	errorUnsupportedOp = 400
+)
+
+type server struct {
+	cfg   *common.DiscoveryServerConfig
+	store *store
+}
+
+func writeJSON(w http.ResponseWriter, status int, index uint64, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(index, 10))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code int, message string, cause string) {
+	writeJSON(w, status, 0, &errorResponse{ErrorCode: code, Message: message, Cause: cause})
+}
+
+func (s *server) handleNew(w http.ResponseWriter, r *http.Request) {
+	size := 3
+	if v := r.FormValue("size"); v != "" {
+		var err error
+		if size, err = strconv.Atoi(v); err != nil || size < 1 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+	name, err := s.store.create(size)
+	if err != nil {
+		fmt.Printf("Error creating token: %s\n", err.Error())
+		http.Error(w, "unable to create token", http.StatusInternalServerError)
+		return
+	}
+	baseURL := s.cfg.BaseURL
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("http://%s", r.Host)
+	}
+	fmt.Printf("Created token '%s' with size %d\n", name, size)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%s/%s", strings.TrimSuffix(baseURL, "/"), name)
+}
+
+func (s *server) handleToken(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	name := parts[0]
+	key := strings.Join(parts[1:], "/")
+	keyPath := fmt.Sprintf("%s/%s", registryPrefix, name)
+
+	switch {
+	case key == "_config/size" && r.Method == "GET":
+		size, index, ok := s.store.size(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, errorKeyNotFound, "Key not found", keyPath)
+			return
+		}
+		writeJSON(w, http.StatusOK, index, &response{Action: "get", Node: &node{
+			Key: keyPath + "/_config/size", Value: strconv.Itoa(size), CreatedIndex: index, ModifiedIndex: index,
+		}})
+	case key == "" && r.Method == "GET":
+		s.list(w, r, name, keyPath)
+	case key == "" || strings.HasPrefix(key, "_"):
+		writeError(w, http.StatusForbidden, errorUnsupportedOp, "Not supported", keyPath+"/"+key)
+	case r.Method == "GET":
+		m, ok := s.store.member(name, key)
+		if !ok {
+			writeError(w, http.StatusNotFound, errorKeyNotFound, "Key not found", keyPath+"/"+key)
+			return
+		}
+		writeJSON(w, http.StatusOK, m.ModifiedIndex, &response{Action: "get", Node: &node{
+			Key: keyPath + "/" + key, Value: m.Value, CreatedIndex: m.CreatedIndex, ModifiedIndex: m.ModifiedIndex,
+		}})
+	case r.Method == "PUT" || r.Method == "POST":
+		value := r.FormValue("value")
+		mustCreate := r.FormValue("prevExist") == "false"
+		m, ok, err := s.store.set(name, key, value, mustCreate)
+		if !ok {
+			writeError(w, http.StatusNotFound, errorKeyNotFound, "Key not found", keyPath)
+			return
+		} else if err != nil && mustCreate {
+			writeError(w, http.StatusPreconditionFailed, errorNodeExist, err.Error(), keyPath+"/"+key)
+			return
+		} else if err != nil {
+			fmt.Printf("Error saving token '%s': %s\n", name, err.Error())
+			writeError(w, http.StatusInternalServerError, errorRaftInternal, err.Error(), keyPath+"/"+key)
+			return
+		}
+		fmt.Printf("Token '%s': registered '%s' = '%s'\n", name, key, value)
+		writeJSON(w, http.StatusCreated, m.ModifiedIndex, &response{Action: "set", Node: &node{
+			Key: keyPath + "/" + key, Value: m.Value, CreatedIndex: m.CreatedIndex, ModifiedIndex: m.ModifiedIndex,
+		}})
+	case r.Method == "DELETE":
+		m, err := s.store.remove(name, key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errorRaftInternal, err.Error(), keyPath+"/"+key)
+			return
+		} else if m == nil {
+			writeError(w, http.StatusNotFound, errorKeyNotFound, "Key not found", keyPath+"/"+key)
+			return
+		}
+		fmt.Printf("Token '%s': removed '%s'\n", name, key)
+		writeJSON(w, http.StatusOK, m.ModifiedIndex, &response{Action: "delete",
+			Node:     &node{Key: keyPath + "/" + key, CreatedIndex: m.CreatedIndex, ModifiedIndex: m.ModifiedIndex},
+			PrevNode: &node{Key: keyPath + "/" + key, Value: m.Value, CreatedIndex: m.CreatedIndex, ModifiedIndex: m.ModifiedIndex},
+		})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// list returns the registered members; with wait=true it first blocks until the token changes
+// past waitIndex
+func (s *server) list(w http.ResponseWriter, r *http.Request, name string, keyPath string) {
+	members, index, changed, ok := s.store.members(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, "Key not found", keyPath)
+		return
+	}
+	if r.FormValue("wait") == "true" {
+		waitIndex, _ := strconv.ParseUint(r.FormValue("waitIndex"), 10, 64)
+		if waitIndex == 0 || waitIndex > index {
+			select {
+			case <-changed:
+				members, index, _, _ = s.store.members(name)
+			case <-time.After(time.Duration(s.cfg.MaxWait) * time.Second):
+			}
+		}
+	}
+
+	dir := &node{Key: keyPath, Dir: true, Nodes: make([]*node, 0), CreatedIndex: 1, ModifiedIndex: index}
+	for _, m := range members {
+		dir.Nodes = append(dir.Nodes, &node{
+			Key: keyPath + "/" + m.ID, Value: m.Value, CreatedIndex: m.CreatedIndex, ModifiedIndex: m.ModifiedIndex,
+		})
+	}
+	writeJSON(w, http.StatusOK, index, &response{Action: "get", Node: dir})
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/new" {
+		s.handleNew(w, r)
+	} else if r.URL.Path == "/health" {
+		fmt.Fprintf(w, "OK")
+	} else {
+		s.handleToken(w, r)
+	}
+}
+
+func Server() {
+	cfg, args, err := common.NewDiscoveryServerConfig(os.Args)
+	// remaining arguments are the program name and the serve-discovery command itself
+	if err != nil {
+		fmt.Printf("Error parsing options: %s\n", err.Error())
+		os.Exit(1)
+	} else if len(args) > 2 {
+		fmt.Printf("Error parsing options; un-parsed options remain: %s\n", strings.Join(args[2:], ", "))
+		os.Exit(1)
+	}
+	st, err := newStore(cfg.StoreDir)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Serving etcd discovery on '%s' from '%s'\n", cfg.Listen, cfg.StoreDir)
+	if err := http.ListenAndServe(cfg.Listen, &server{cfg: cfg, store: st}); err != nil {
+		fmt.Printf("Error serving discovery: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,101 @@
+package discovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ScriptRock/peerdiscovery/common"
+)
+
+func startTestServer(t *testing.T) *httptest.Server {
+	cfg := &common.DiscoveryServerConfig{MaxWait: 5}
+	server := httptest.NewServer(&server{cfg: cfg, store: newTestStore(t)})
+	t.Cleanup(server.Close)
+	return server
+}
+
+// call makes a request and decodes the etcd style response, returning the status code
+func call(t *testing.T, method string, u string, form url.Values) (int, *response) {
+	req, err := http.NewRequest(method, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := &response{}
+	json.NewDecoder(resp.Body).Decode(r)
+	return resp.StatusCode, r
+}
+
+func newToken(t *testing.T, server *httptest.Server, size string) string {
+	resp, err := http.Get(server.URL + "/new?size=" + size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), server.URL+"/") {
+		t.Fatalf("/new returned %s '%s'", resp.Status, string(body))
+	}
+	return string(body)
+}
+
+func TestServerToken(t *testing.T) {
+	server := startTestServer(t)
+	token := newToken(t, server, "2")
+
+	if status, r := call(t, "GET", token+"/_config/size", nil); status != http.StatusOK || r.Node.Value != "2" {
+		t.Errorf("size: %d %+v", status, r.Node)
+	}
+	register := url.Values{"value": {"a=http://10.0.0.1:7001"}, "prevExist": {"false"}}
+	if status, r := call(t, "PUT", token+"/id-a", register); status != http.StatusCreated || r.Action != "set" {
+		t.Errorf("register: %d %+v", status, r)
+	}
+	if status, _ := call(t, "PUT", token+"/id-a", register); status != http.StatusPreconditionFailed {
+		t.Errorf("second register with prevExist=false: %d, want %d", status, http.StatusPreconditionFailed)
+	}
+	if status, r := call(t, "GET", token+"/id-a", nil); status != http.StatusOK || r.Node.Value != "a=http://10.0.0.1:7001" {
+		t.Errorf("get member: %d %+v", status, r.Node)
+	}
+	if status, _ := call(t, "PUT", token+"/_config/size", url.Values{"value": {"5"}}); status != http.StatusForbidden {
+		t.Errorf("overwriting the size: %d, want %d", status, http.StatusForbidden)
+	}
+	if status, _ := call(t, "GET", server.URL+"/no-such-token", nil); status != http.StatusNotFound {
+		t.Errorf("unknown token: %d, want %d", status, http.StatusNotFound)
+	}
+
+	// a waiting client sees the next registration
+	_, r := call(t, "GET", token, nil)
+	waitIndex := r.Node.ModifiedIndex + 1
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if resp, err := http.PostForm(token+"/id-b", url.Values{"value": {"b=http://10.0.0.2:7001"}}); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	start := time.Now()
+	status, r := call(t, "GET", token+"?wait=true&waitIndex="+strconv.FormatUint(waitIndex, 10), nil)
+	if status != http.StatusOK || len(r.Node.Nodes) != 2 || time.Since(start) >= 5*time.Second {
+		t.Errorf("wait: %d with %d members after %s", status, len(r.Node.Nodes), time.Since(start).String())
+	} else if r.Node.Nodes[0].Value != "a=http://10.0.0.1:7001" || r.Node.Nodes[1].Value != "b=http://10.0.0.2:7001" {
+		t.Errorf("members %+v %+v, want a then b", r.Node.Nodes[0], r.Node.Nodes[1])
+	}
+
+	if status, r := call(t, "DELETE", token+"/id-a", nil); status != http.StatusOK || r.PrevNode.Value != "a=http://10.0.0.1:7001" {
+		t.Errorf("delete: %d %+v", status, r)
+	}
+	if status, _ := call(t, "GET", token+"/id-a", nil); status != http.StatusNotFound {
+		t.Errorf("deleted member: %d, want %d", status, http.StatusNotFound)
+	}
+}
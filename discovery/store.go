@@ -0,0 +1,202 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+var validToken = regexp.MustCompile("^[0-9a-zA-Z_-]+$")
+
+type member struct {
+	Value         string `json:"value"`
+	CreatedIndex  uint64 `json:"createdIndex"`
+	ModifiedIndex uint64 `json:"modifiedIndex"`
+}
+
+type token struct {
+	Size    int                `json:"size"`
+	Index   uint64             `json:"index"`
+	Members map[string]*member `json:"members"`
+}
+
+type namedMember struct {
+	ID string
+	*member
+}
+
+// store keeps each token in its own JSON file so that a restart loses nothing
+type store struct {
+	mutex   sync.Mutex
+	dir     string
+	tokens  map[string]*token
+	changed map[string]chan bool
+}
+
+func newStore(dir string) (*store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create store directory '%s': %s", dir, err.Error())
+	}
+	return &store{
+		dir:     dir,
+		tokens:  make(map[string]*token),
+		changed: make(map[string]chan bool),
+	}, nil
+}
+
+func (s *store) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// load returns the named token, reading it from disk on first use. Caller holds the mutex.
+func (s *store) load(name string) *token {
+	if !validToken.MatchString(name) {
+		return nil
+	}
+	if t, ok := s.tokens[name]; ok {
+		return t
+	}
+	fileData, err := ioutil.ReadFile(s.path(name))
+	if err != nil {
+		return nil
+	}
+	t := &token{}
+	if err := json.Unmarshal(fileData, t); err != nil {
+		fmt.Printf("Invalid token file '%s': %s\n", s.path(name), err.Error())
+		return nil
+	}
+	if t.Members == nil {
+		t.Members = make(map[string]*member)
+	}
+	s.tokens[name] = t
+	return t
+}
+
+// save writes the token to disk and wakes any waiters. Caller holds the mutex.
+func (s *store) save(name string, t *token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path(name) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path(name)); err != nil {
+		return err
+	}
+	if ch, ok := s.changed[name]; ok {
+		close(ch)
+		delete(s.changed, name)
+	}
+	return nil
+}
+
+func (s *store) create(size int) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(buf)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t := &token{Size: size, Index: 1, Members: make(map[string]*member)}
+	s.tokens[name] = t
+	return name, s.save(name, t)
+}
+
+func (s *store) size(name string) (int, uint64, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t := s.load(name)
+	if t == nil {
+		return 0, 0, false
+	}
+	return t.Size, 1, true
+}
+
+// members returns the members in registration order, the current index, and a channel that is
+// closed on the next change
+func (s *store) members(name string) ([]namedMember, uint64, chan bool, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t := s.load(name)
+	if t == nil {
+		return nil, 0, nil, false
+	}
+	members := make([]namedMember, 0, len(t.Members))
+	for id, m := range t.Members {
+		members = append(members, namedMember{ID: id, member: m})
+	}
+	sort.Sort(byCreatedIndex(members))
+
+	ch, ok := s.changed[name]
+	if !ok {
+		ch = make(chan bool)
+		s.changed[name] = ch
+	}
+	return members, t.Index, ch, true
+}
+
+func (s *store) member(name string, id string) (*member, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t := s.load(name)
+	if t == nil {
+		return nil, false
+	}
+	m, ok := t.Members[id]
+	return m, ok
+}
+
+// set registers or updates a member. With mustCreate, an existing member is an error.
+func (s *store) set(name string, id string, value string, mustCreate bool) (*member, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t := s.load(name)
+	if t == nil {
+		return nil, false, nil
+	}
+	m, exists := t.Members[id]
+	if exists && mustCreate {
+		return m, true, fmt.Errorf("Key already exists")
+	}
+	t.Index++
+	if !exists {
+		m = &member{CreatedIndex: t.Index}
+		t.Members[id] = m
+	}
+	m.Value = value
+	m.ModifiedIndex = t.Index
+	return m, true, s.save(name, t)
+}
+
+func (s *store) remove(name string, id string) (*member, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t := s.load(name)
+	if t == nil {
+		return nil, nil
+	}
+	m, ok := t.Members[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(t.Members, id)
+	t.Index++
+	return m, s.save(name, t)
+}
+
+type byCreatedIndex []namedMember
+
+func (m byCreatedIndex) Len() int           { return len(m) }
+func (m byCreatedIndex) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byCreatedIndex) Less(i, j int) bool { return m[i].CreatedIndex < m[j].CreatedIndex }
@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *store {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := newStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStoreMembers(t *testing.T) {
+	s := newTestStore(t)
+	name, err := s.create(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, changed, _ := s.members(name)
+	for _, id := range []string{"c", "a", "b"} {
+		if _, ok, err := s.set(name, id, id+"=http://"+id+":7001", true); !ok || err != nil {
+			t.Fatalf("registering '%s': ok %v, %v", id, ok, err)
+		}
+	}
+	select {
+	case <-changed:
+	default:
+		t.Errorf("waiters were not woken by a registration")
+	}
+
+	if _, ok, err := s.set(name, "a", "a=http://elsewhere:7001", true); !ok || err == nil {
+		t.Errorf("registered 'a' twice with prevExist=false")
+	}
+	if m, _, err := s.set(name, "a", "a=http://a:2380", false); err != nil || m.Value != "a=http://a:2380" {
+		t.Errorf("updating 'a': %v, %v", m, err)
+	}
+	if m, err := s.remove(name, "b"); err != nil || m == nil {
+		t.Errorf("removing 'b': %v, %v", m, err)
+	}
+	if m, err := s.remove(name, "b"); m != nil || err != nil {
+		t.Errorf("removed 'b' twice: %v, %v", m, err)
+	}
+
+	// a restarted server reads the token back from its file
+	reloaded, err := newStore(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, index, _, ok := reloaded.members(name)
+	if !ok {
+		t.Fatalf("token '%s' lost on reload", name)
+	}
+	if len(members) != 2 || members[0].ID != "c" || members[1].ID != "a" || members[1].Value != "a=http://a:2380" {
+		t.Errorf("reloaded members %+v, want c then the updated a, in registration order", members)
+	}
+	if size, _, _ := reloaded.size(name); size != 3 || index != 6 {
+		t.Errorf("reloaded size %d index %d, want 3 and 6", size, index)
+	}
+}
+
+func TestStoreTokenNames(t *testing.T) {
+	s := newTestStore(t)
+	for _, name := range []string{"missing", "../etc/passwd", "a/b", ""} {
+		if _, _, _, ok := s.members(name); ok {
+			t.Errorf("token '%s' found", name)
+		}
+		if _, ok, _ := s.set(name, "a", "a=http://a:7001", false); ok {
+			t.Errorf("registered under token '%s'", name)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package mdns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type packet struct {
+	data          []byte
+	interfaceName string
+}
+
+type browser struct {
+	service   string
+	domain    string
+	conns     []packetConn
+	ifaces    []net.Interface
+	instances map[string]*Entry   // keyed by full instance name
+	hosts     map[string][]net.IP // keyed by full host name
+	queried   map[string]bool     // follow-up queries already sent
+	emitted   map[string]bool
+}
+
+// Browse sends a PTR query for service.domain on every multicast interface, resolves the
+// instances found, and sends each fully resolved instance to results. It returns once
+// timeout has elapsed.
+func Browse(service string, domain string, timeout time.Duration, results chan *Entry) error {
+	b := &browser{
+		service:   service,
+		domain:    domain,
+		conns:     listenUnicast(),
+		ifaces:    multicastInterfaces(),
+		instances: make(map[string]*Entry),
+		hosts:     make(map[string][]net.IP),
+		queried:   make(map[string]bool),
+		emitted:   make(map[string]bool),
+	}
+	if len(b.conns) == 0 {
+		return fmt.Errorf("mdns: no sockets available for browsing")
+	}
+	defer func() {
+		for _, c := range b.conns {
+			c.close()
+		}
+	}()
+
+	b.send(question(serviceName(service, domain), dnsmessage.TypePTR, true))
+
+	deadline := time.Now().Add(timeout)
+	packets := make(chan *packet, 32)
+	done := make(chan bool, len(b.conns))
+	for _, c := range b.conns {
+		go b.read(c, deadline, packets, done)
+	}
+
+	for running := len(b.conns); running > 0; {
+		select {
+		case p := <-packets:
+			b.handle(p, results)
+		case <-done:
+			running--
+		}
+	}
+
+	// responders that never answered for TXT still give us enough to use
+	for name, e := range b.instances {
+		if !b.emitted[name] && e.resolved() {
+			b.emitted[name] = true
+			results <- e
+		}
+	}
+	return nil
+}
+
+func (b *browser) read(c packetConn, deadline time.Time, packets chan *packet, done chan bool) {
+	c.setReadDeadline(deadline)
+	buf := make([]byte, 9000)
+	for {
+		n, ifIndex, _, err := c.readFrom(buf)
+		if err != nil {
+			break
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		packets <- &packet{data: data, interfaceName: interfaceName(ifIndex)}
+	}
+	done <- true
+}
+
+func (b *browser) send(questions ...dnsmessage.Question) {
+	query, err := newQuery(questions...)
+	if err != nil {
+		fmt.Printf("mdns: Error packing query: %s\n", err.Error())
+		return
+	}
+	for _, c := range b.conns {
+		if len(b.ifaces) == 0 {
+			c.writeTo(query, nil, c.group())
+		}
+		// not every interface has every address family, so write errors are expected and ignored
+		for i := range b.ifaces {
+			c.writeTo(query, &b.ifaces[i], c.group())
+		}
+	}
+}
+
+func (b *browser) handle(p *packet, results chan *Entry) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(p.data); err != nil || !msg.Header.Response {
+		return
+	}
+
+	suffix := strings.ToLower(serviceName(b.service, b.domain))
+	records := append(append(msg.Answers, msg.Authorities...), msg.Additionals...)
+
+	// PTR records first so that SRV/TXT in the same packet find their instance
+	for _, rr := range records {
+		if ptr, ok := rr.Body.(*dnsmessage.PTRResource); ok {
+			if strings.ToLower(rr.Header.Name.String()) != suffix {
+				continue
+			}
+			name := ptr.PTR.String()
+			if !strings.HasSuffix(strings.ToLower(name), suffix) {
+				continue
+			}
+			if _, exists := b.instances[strings.ToLower(name)]; !exists && rr.Header.TTL > 0 {
+				b.instances[strings.ToLower(name)] = &Entry{
+					Instance: strings.TrimSuffix(name[:len(name)-len(suffix)], "."),
+					Service:  b.service,
+					Domain:   b.domain,
+				}
+			}
+		}
+	}
+
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header.Name.String())
+		switch body := rr.Body.(type) {
+		case *dnsmessage.SRVResource:
+			if e, ok := b.instances[name]; ok && !b.emitted[name] {
+				e.Host = strings.TrimSuffix(body.Target.String(), ".")
+				e.Port = int(body.Port)
+			}
+		case *dnsmessage.TXTResource:
+			if e, ok := b.instances[name]; ok && !b.emitted[name] {
+				e.Text = make([]string, 0, len(body.TXT))
+				for _, s := range body.TXT {
+					if s != "" {
+						e.Text = append(e.Text, s)
+					}
+				}
+			}
+		case *dnsmessage.AResource:
+			b.hosts[name] = append(b.hosts[name], net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			b.hosts[name] = append(b.hosts[name], net.IP(body.AAAA[:]))
+		}
+	}
+
+	for name, e := range b.instances {
+		if b.emitted[name] {
+			// the consumer owns it now; later answers must not change it under them
+			continue
+		}
+		if e.InterfaceName == "" {
+			e.InterfaceName = p.interfaceName
+		}
+		if e.Host != "" {
+			for _, ip := range b.hosts[strings.ToLower(fqdn(e.Host))] {
+				if ip.To4() != nil {
+					if e.IPv4 == nil {
+						e.IPv4 = ip.To4()
+					}
+				} else if e.IPv6 == nil || (e.IPv6.IsLinkLocalUnicast() && !ip.IsLinkLocalUnicast()) {
+					// a global address is usable from further away than a link-local one
+					e.IPv6 = ip
+				}
+			}
+		}
+		if e.complete() {
+			b.emitted[name] = true
+			results <- e
+			continue
+		}
+		b.followUp(name, e)
+	}
+}
+
+// followUp asks directly for whatever parts of an instance are still missing
+func (b *browser) followUp(name string, e *Entry) {
+	questions := make([]dnsmessage.Question, 0)
+	if e.Port == 0 && !b.queried[name+"/srv"] {
+		b.queried[name+"/srv"] = true
+		questions = append(questions, question(name, dnsmessage.TypeSRV, true))
+	}
+	if e.Text == nil && !b.queried[name+"/txt"] {
+		b.queried[name+"/txt"] = true
+		questions = append(questions, question(name, dnsmessage.TypeTXT, true))
+	}
+	if e.Host != "" && e.IPv4 == nil && e.IPv6 == nil && !b.queried[e.Host] {
+		b.queried[e.Host] = true
+		questions = append(questions,
+			question(e.Host, dnsmessage.TypeA, true),
+			question(e.Host, dnsmessage.TypeAAAA, true))
+	}
+	if len(questions) > 0 {
+		b.send(questions...)
+	}
+}
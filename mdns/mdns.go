@@ -0,0 +1,290 @@
+package mdns
+
+/*
+
+Minimal multicast DNS / DNS-SD implementation
+
+-- Browses for service instances by sending PTR queries to 224.0.0.251 / ff02::fb and resolving SRV/TXT/A/AAAA.
+-- Answers queries for our own service instance, probing for name conflicts first and sending goodbyes on shutdown.
+-- Used in place of avahi-browse and avahi-daemon so that hosts without avahi can still find their peers.
+
+*/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const Port = 5353
+
+var (
+	IPv4Group = net.IPv4(224, 0, 0, 251)
+	IPv6Group = net.ParseIP("ff02::fb")
+)
+
+// top bit of the question class requests a unicast response, top bit of an answer class is cache flush
+const classUnicastResponse = 1 << 15
+const classCacheFlush = 1 << 15
+
+// Entry is a resolved DNS-SD service instance
+type Entry struct {
+	Instance      string // test
+	Service       string // _scriptrock_etcd._tcp
+	Domain        string // local
+	Host          string // mark-ubuntu-vm.local
+	InterfaceName string // eth1
+	IPv4          net.IP
+	IPv6          net.IP
+	Port          int
+	Text          []string
+}
+
+func (e *Entry) resolved() bool {
+	return e.Host != "" && e.Port != 0 && (e.IPv4 != nil || e.IPv6 != nil)
+}
+
+func (e *Entry) complete() bool {
+	return e.resolved() && e.Text != nil
+}
+
+func serviceName(service string, domain string) string {
+	return fmt.Sprintf("%s.%s.", strings.Trim(service, "."), strings.Trim(domain, "."))
+}
+
+func instanceName(instance string, service string, domain string) string {
+	return fmt.Sprintf("%s.%s", instance, serviceName(service, domain))
+}
+
+// subtypeName is the DNS-SD name browsed to find only the instances of service with a subtype
+func subtypeName(subtype string, service string, domain string) string {
+	return fmt.Sprintf("%s._sub.%s", subtype, serviceName(service, domain))
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// packetConn hides the differences between the ipv4 and ipv6 packet connections
+type packetConn interface {
+	readFrom(b []byte) (int, int, net.Addr, error)
+	writeTo(b []byte, iface *net.Interface, dst net.Addr) error
+	group() *net.UDPAddr
+	setReadDeadline(t time.Time) error
+	close() error
+}
+
+type conn4 struct {
+	pc *ipv4.PacketConn
+}
+
+func (c *conn4) readFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.pc.ReadFrom(b)
+	ifIndex := 0
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	return n, ifIndex, src, err
+}
+
+func (c *conn4) writeTo(b []byte, iface *net.Interface, dst net.Addr) error {
+	if iface != nil {
+		if err := c.pc.SetMulticastInterface(iface); err != nil {
+			return err
+		}
+	}
+	_, err := c.pc.WriteTo(b, nil, dst)
+	return err
+}
+
+func (c *conn4) group() *net.UDPAddr {
+	return &net.UDPAddr{IP: IPv4Group, Port: Port}
+}
+
+func (c *conn4) setReadDeadline(t time.Time) error {
+	return c.pc.SetReadDeadline(t)
+}
+
+func (c *conn4) close() error {
+	return c.pc.Close()
+}
+
+type conn6 struct {
+	pc *ipv6.PacketConn
+}
+
+func (c *conn6) readFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.pc.ReadFrom(b)
+	ifIndex := 0
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	return n, ifIndex, src, err
+}
+
+func (c *conn6) writeTo(b []byte, iface *net.Interface, dst net.Addr) error {
+	if iface != nil {
+		if err := c.pc.SetMulticastInterface(iface); err != nil {
+			return err
+		}
+	}
+	_, err := c.pc.WriteTo(b, nil, dst)
+	return err
+}
+
+func (c *conn6) group() *net.UDPAddr {
+	return &net.UDPAddr{IP: IPv6Group, Port: Port}
+}
+
+func (c *conn6) setReadDeadline(t time.Time) error {
+	return c.pc.SetReadDeadline(t)
+}
+
+func (c *conn6) close() error {
+	return c.pc.Close()
+}
+
+// listenUnicast opens ephemeral-port sockets for sending queries; responders answer these directly.
+func listenUnicast() []packetConn {
+	conns := make([]packetConn, 0)
+	if c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0}); err != nil {
+		fmt.Printf("mdns: could not open IPv4 socket: %s\n", err.Error())
+	} else {
+		pc := ipv4.NewPacketConn(c)
+		pc.SetControlMessage(ipv4.FlagInterface, true)
+		conns = append(conns, &conn4{pc: pc})
+	}
+	if c, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: 0}); err != nil {
+		fmt.Printf("mdns: could not open IPv6 socket: %s\n", err.Error())
+	} else {
+		pc := ipv6.NewPacketConn(c)
+		pc.SetControlMessage(ipv6.FlagInterface, true)
+		conns = append(conns, &conn6{pc: pc})
+	}
+	return conns
+}
+
+// reuseAddr lets us share the mDNS port with avahi-daemon and other responders
+func reuseAddr(network string, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if sockErr == nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// listenMulticast opens sockets bound to the mDNS port and joins the mDNS groups on every interface.
+// The sockets are bound to the wildcard address rather than the group so that what we send
+// carries a real source address.
+func listenMulticast(ifaces []net.Interface) []packetConn {
+	conns := make([]packetConn, 0)
+	lc := net.ListenConfig{Control: reuseAddr}
+	if c, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", Port)); err != nil {
+		fmt.Printf("mdns: could not listen on IPv4 multicast: %s\n", err.Error())
+	} else {
+		pc := ipv4.NewPacketConn(c)
+		pc.SetControlMessage(ipv4.FlagInterface, true)
+		pc.SetMulticastTTL(255)
+		pc.SetMulticastLoopback(true)
+		joined := 0
+		for i := range ifaces {
+			if pc.JoinGroup(&ifaces[i], &net.UDPAddr{IP: IPv4Group}) == nil {
+				joined++
+			}
+		}
+		if joined == 0 {
+			pc.JoinGroup(nil, &net.UDPAddr{IP: IPv4Group})
+		}
+		conns = append(conns, &conn4{pc: pc})
+	}
+	if c, err := lc.ListenPacket(context.Background(), "udp6", fmt.Sprintf("[::]:%d", Port)); err != nil {
+		fmt.Printf("mdns: could not listen on IPv6 multicast: %s\n", err.Error())
+	} else {
+		pc := ipv6.NewPacketConn(c)
+		pc.SetControlMessage(ipv6.FlagInterface, true)
+		pc.SetMulticastHopLimit(255)
+		pc.SetMulticastLoopback(true)
+		joined := 0
+		for i := range ifaces {
+			if pc.JoinGroup(&ifaces[i], &net.UDPAddr{IP: IPv6Group}) == nil {
+				joined++
+			}
+		}
+		if joined == 0 {
+			pc.JoinGroup(nil, &net.UDPAddr{IP: IPv6Group})
+		}
+		conns = append(conns, &conn6{pc: pc})
+	}
+	return conns
+}
+
+func multicastInterfaces() []net.Interface {
+	result := make([]net.Interface, 0)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		fmt.Printf("mdns: Error getting interfaces: %s\n", err.Error())
+		return result
+	}
+	for _, iface := range ifaces {
+		if (iface.Flags & net.FlagLoopback) != 0 {
+			continue
+		}
+		if (iface.Flags&net.FlagUp) == 0 || (iface.Flags&net.FlagMulticast) == 0 {
+			continue
+		}
+		result = append(result, iface)
+	}
+	return result
+}
+
+func interfaceName(ifIndex int) string {
+	if ifIndex == 0 {
+		return ""
+	}
+	if iface, err := net.InterfaceByIndex(ifIndex); err == nil {
+		return iface.Name
+	}
+	return ""
+}
+
+func newQuery(questions ...dnsmessage.Question) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{},
+		Questions: questions,
+	}
+	return msg.Pack()
+}
+
+func question(name string, t dnsmessage.Type, unicast bool) dnsmessage.Question {
+	class := dnsmessage.ClassINET
+	if unicast {
+		class |= classUnicastResponse
+	}
+	return dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(fqdn(name)),
+		Type:  t,
+		Class: class,
+	}
+}
+
+func txtStrings(txt []string) []string {
+	// DNS-SD requires at least one (possibly empty) string in a TXT record
+	if len(txt) == 0 {
+		return []string{""}
+	}
+	return txt
+}
@@ -0,0 +1,614 @@
+package mdns
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultTTL     = 120
+	hostTTL        = 120
+	legacyTTL      = 10
+	probeCount     = 3
+	probeInterval  = 250 * time.Millisecond
+	maxRenames     = 15
+	announceRepeat = 2
+)
+
+// Service describes the DNS-SD service instance announced by a Responder
+type Service struct {
+	Instance string   // instance label, e.g. the machine UUID
+	Service  string   // _scriptrock_etcd._tcp
+	Domain   string   // local
+	Host     string   // host label without domain
+	Port     int      // port advertised in the SRV record
+	Text     []string // TXT key=value strings
+	Subtypes []string // subtype labels such as _prod, answered as _prod._sub.<service>
+}
+
+type Responder struct {
+	mutex     sync.Mutex
+	service   Service
+	conns     []packetConn
+	ifaces    []net.Interface
+	probing   bool
+	announced bool
+	conflicts chan string
+	tiebreaks chan string
+	done      chan bool
+	shutdown  sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewResponder(service Service) *Responder {
+	return &Responder{
+		service:   service,
+		ifaces:    multicastInterfaces(),
+		conflicts: make(chan string, 16),
+		tiebreaks: make(chan string, 16),
+		done:      make(chan bool),
+	}
+}
+
+// Start probes for our instance and host names, renaming on conflict, then announces the
+// service and answers queries in the background until Shutdown is called.
+func (r *Responder) Start() error {
+	r.conns = listenMulticast(r.ifaces)
+	if len(r.conns) == 0 {
+		return fmt.Errorf("mdns: no sockets available for responding")
+	}
+	for _, c := range r.conns {
+		r.wg.Add(1)
+		go r.serve(c)
+	}
+
+	if err := r.probe(); err != nil {
+		r.Shutdown()
+		return err
+	}
+	r.mutex.Lock()
+	r.announced = true
+	r.mutex.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for i := 0; i < announceRepeat; i++ {
+			r.announce(defaultTTL)
+			select {
+			case <-r.done:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	return nil
+}
+
+// Instance returns the instance name in use, which differs from the requested one after a conflict
+func (r *Responder) Instance() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.service.Instance
+}
+
+// Host returns the host label in use
+func (r *Responder) Host() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.service.Host
+}
+
+// SetText replaces the TXT record and announces the change, unless we are not (or no longer)
+// announcing
+func (r *Responder) SetText(txt []string) {
+	r.mutex.Lock()
+	r.service.Text = txt
+	announced := r.announced
+	r.mutex.Unlock()
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	if announced {
+		r.announce(defaultTTL)
+	}
+}
+
+// Shutdown sends goodbye packets so peers drop our records immediately, then closes the sockets.
+// It may be called more than once, and from more than one goroutine (e.g. a signal handler).
+func (r *Responder) Shutdown() {
+	r.shutdown.Do(func() {
+		r.mutex.Lock()
+		announced := r.announced
+		r.mutex.Unlock()
+		if announced {
+			r.announce(0)
+		}
+		close(r.done)
+		for _, c := range r.conns {
+			c.close()
+		}
+	})
+	r.wg.Wait()
+}
+
+func (r *Responder) names() (string, string, string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := r.service
+	return strings.ToLower(serviceName(s.Service, s.Domain)),
+		strings.ToLower(instanceName(s.Instance, s.Service, s.Domain)),
+		strings.ToLower(fqdn(s.Host + "." + strings.Trim(s.Domain, ".")))
+}
+
+func (r *Responder) probe() error {
+	r.mutex.Lock()
+	baseInstance := r.service.Instance
+	baseHost := r.service.Host
+	r.mutex.Unlock()
+
+	instanceN, hostN := 1, 1
+	for rename := 1; rename <= maxRenames; rename++ {
+		r.mutex.Lock()
+		r.probing = true
+		r.mutex.Unlock()
+
+		_, instance, host := r.names()
+		conflict, lost := "", ""
+		for i := 0; i < probeCount && conflict == "" && lost == ""; i++ {
+			r.sendProbe(instance, host)
+			select {
+			case conflict = <-r.conflicts:
+			case lost = <-r.tiebreaks:
+			case <-time.After(probeInterval):
+			}
+		}
+
+		r.mutex.Lock()
+		r.probing = false
+		if conflict == "" && lost == "" {
+			r.mutex.Unlock()
+			return nil
+		}
+		if conflict == "" {
+			// another host probing for the same name won the tiebreak. Give it a second to claim the
+			// name, then probe again; if it did, its answers will show up as a conflict (RFC 6762 8.2)
+			r.mutex.Unlock()
+			fmt.Printf("mdns: lost simultaneous probe tiebreak for '%s'; probing again\n", lost)
+			for len(r.tiebreaks) > 0 {
+				<-r.tiebreaks
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if conflict == instance {
+			instanceN++
+			r.service.Instance = fmt.Sprintf("%s-%d", baseInstance, instanceN)
+			fmt.Printf("mdns: instance name conflict; renaming to '%s'\n", r.service.Instance)
+		} else {
+			hostN++
+			r.service.Host = fmt.Sprintf("%s-%d", baseHost, hostN)
+			fmt.Printf("mdns: host name conflict; renaming to '%s'\n", r.service.Host)
+		}
+		r.mutex.Unlock()
+
+		// drain any further conflicts for the old names
+		for len(r.conflicts) > 0 {
+			<-r.conflicts
+		}
+	}
+	return fmt.Errorf("mdns: could not find a free name after %d attempts", maxRenames)
+}
+
+func (r *Responder) sendProbe(instance string, host string) {
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{
+			question(instance, dnsmessage.TypeALL, false),
+			question(host, dnsmessage.TypeALL, false),
+		},
+	}
+	// proposed records go in the authority section so simultaneous probes can be detected
+	srv, txt := r.instanceRecords(defaultTTL)
+	msg.Authorities = append(msg.Authorities, srv, txt)
+	for _, c := range r.conns {
+		for i := range r.ifaces {
+			m := msg
+			m.Authorities = append(m.Authorities, r.addressRecords(r.ifaces[i].Index, hostTTL)...)
+			if packed, err := m.Pack(); err == nil {
+				c.writeTo(packed, &r.ifaces[i], c.group())
+			}
+		}
+	}
+}
+
+func (r *Responder) announce(ttl uint32) {
+	for _, c := range r.conns {
+		for i := range r.ifaces {
+			msg := dnsmessage.Message{
+				Header:  dnsmessage.Header{Response: true, Authoritative: true},
+				Answers: append(r.serviceRecords(ttl), r.addressRecords(r.ifaces[i].Index, ttl)...),
+			}
+			if packed, err := msg.Pack(); err == nil {
+				c.writeTo(packed, &r.ifaces[i], c.group())
+			}
+		}
+	}
+}
+
+func (r *Responder) serve(c packetConn) {
+	defer r.wg.Done()
+	buf := make([]byte, 9000)
+	for {
+		n, ifIndex, src, err := c.readFrom(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		if msg.Header.Response {
+			r.checkConflict(&msg)
+		} else {
+			r.checkProbe(&msg, ifIndex)
+			r.answer(c, &msg, ifIndex, src)
+		}
+	}
+}
+
+func (r *Responder) checkConflict(msg *dnsmessage.Message) {
+	r.mutex.Lock()
+	probing := r.probing
+	r.mutex.Unlock()
+	if !probing {
+		return
+	}
+	_, instance, host := r.names()
+	for _, rr := range append(msg.Answers, msg.Additionals...) {
+		name := strings.ToLower(rr.Header.Name.String())
+		if name == instance || name == host {
+			select {
+			case r.conflicts <- name:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// checkProbe handles a probe from another host for a name we are probing for ourselves. Each side
+// compares the records proposed in the authority sections, and the one whose records sort later
+// keeps the name (RFC 6762 8.2). Our own probes come back to us with identical records, and tie.
+func (r *Responder) checkProbe(query *dnsmessage.Message, ifIndex int) {
+	r.mutex.Lock()
+	probing := r.probing
+	r.mutex.Unlock()
+	if !probing || len(query.Authorities) == 0 {
+		return
+	}
+	_, instance, host := r.names()
+	srv, txt := r.instanceRecords(defaultTTL)
+	proposed := map[string][]dnsmessage.Resource{
+		instance: {srv, txt},
+		host:     r.addressRecords(ifIndex, hostTTL),
+	}
+	for name, ours := range proposed {
+		theirs := make([]dnsmessage.Resource, 0)
+		for _, rr := range query.Authorities {
+			if strings.ToLower(rr.Header.Name.String()) == name {
+				theirs = append(theirs, rr)
+			}
+		}
+		if len(theirs) > 0 && compareRecords(ours, theirs) < 0 {
+			select {
+			case r.tiebreaks <- name:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// compareRecords orders two sets of proposed records for the probe tiebreak. Each set is sorted by
+// class, type and rdata and the sets compared record by record; a set that runs out first is the
+// earlier one.
+func compareRecords(a []dnsmessage.Resource, b []dnsmessage.Resource) int {
+	a, b = sortedRecords(a), sortedRecords(b)
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareRecord(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func sortedRecords(records []dnsmessage.Resource) []dnsmessage.Resource {
+	sorted := append([]dnsmessage.Resource(nil), records...)
+	sort.Slice(sorted, func(i, j int) bool { return compareRecord(sorted[i], sorted[j]) < 0 })
+	return sorted
+}
+
+func compareRecord(a dnsmessage.Resource, b dnsmessage.Resource) int {
+	// the cache flush bit is not part of the class
+	if ac, bc := a.Header.Class&^classCacheFlush, b.Header.Class&^classCacheFlush; ac != bc {
+		return int(ac) - int(bc)
+	}
+	at, aData := rdata(a.Body)
+	bt, bData := rdata(b.Body)
+	if at != bt {
+		return int(at) - int(bt)
+	}
+	return bytes.Compare(aData, bData)
+}
+
+// rdata returns the type and uncompressed wire form of the record types we propose when probing.
+// The type comes from the body, since records we build ourselves have it set only when packed.
+func rdata(body dnsmessage.ResourceBody) (dnsmessage.Type, []byte) {
+	switch body := body.(type) {
+	case *dnsmessage.AResource:
+		return dnsmessage.TypeA, body.A[:]
+	case *dnsmessage.AAAAResource:
+		return dnsmessage.TypeAAAA, body.AAAA[:]
+	case *dnsmessage.SRVResource:
+		b := []byte{
+			byte(body.Priority >> 8), byte(body.Priority),
+			byte(body.Weight >> 8), byte(body.Weight),
+			byte(body.Port >> 8), byte(body.Port),
+		}
+		for _, label := range strings.Split(strings.TrimSuffix(body.Target.String(), "."), ".") {
+			b = append(append(b, byte(len(label))), label...)
+		}
+		return dnsmessage.TypeSRV, append(b, 0)
+	case *dnsmessage.TXTResource:
+		b := make([]byte, 0)
+		for _, s := range body.TXT {
+			b = append(append(b, byte(len(s))), s...)
+		}
+		return dnsmessage.TypeTXT, b
+	}
+	return 0, nil
+}
+
+func (r *Responder) answer(c packetConn, query *dnsmessage.Message, ifIndex int, src net.Addr) {
+	r.mutex.Lock()
+	announced := r.announced
+	r.mutex.Unlock()
+	if !announced {
+		// names are not ours until probing completes
+		return
+	}
+
+	udpSrc, ok := src.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	legacy := udpSrc.Port != Port
+	ttl := uint32(defaultTTL)
+	if legacy {
+		ttl = legacyTTL
+	}
+
+	service, instance, host := r.names()
+	browseAll := strings.ToLower(r.browseName())
+
+	answers := make([]dnsmessage.Resource, 0)
+	additionals := make([]dnsmessage.Resource, 0)
+	for _, q := range query.Questions {
+		name := strings.ToLower(q.Name.String())
+		qtype := q.Type
+		switch {
+		case name == browseAll && (qtype == dnsmessage.TypePTR || qtype == dnsmessage.TypeALL):
+			answers = append(answers, r.browseRecord(ttl))
+		case name == service && (qtype == dnsmessage.TypePTR || qtype == dnsmessage.TypeALL):
+			answers = append(answers, r.ptrRecord(ttl))
+			srv, txt := r.instanceRecords(ttl)
+			additionals = append(additionals, srv, txt)
+			additionals = append(additionals, r.addressRecords(ifIndex, ttl)...)
+		case r.isSubtype(name) && (qtype == dnsmessage.TypePTR || qtype == dnsmessage.TypeALL):
+			answers = append(answers, r.subtypeRecord(name, ttl))
+			srv, txt := r.instanceRecords(ttl)
+			additionals = append(additionals, srv, txt)
+			additionals = append(additionals, r.addressRecords(ifIndex, ttl)...)
+		case name == instance:
+			srv, txt := r.instanceRecords(ttl)
+			switch qtype {
+			case dnsmessage.TypeSRV:
+				answers = append(answers, srv)
+				additionals = append(additionals, r.addressRecords(ifIndex, ttl)...)
+			case dnsmessage.TypeTXT:
+				answers = append(answers, txt)
+			case dnsmessage.TypeALL:
+				answers = append(answers, srv, txt)
+				additionals = append(additionals, r.addressRecords(ifIndex, ttl)...)
+			}
+		case name == host:
+			for _, rr := range r.addressRecords(ifIndex, ttl) {
+				_, isA := rr.Body.(*dnsmessage.AResource)
+				if qtype == dnsmessage.TypeALL || (qtype == dnsmessage.TypeA && isA) || (qtype == dnsmessage.TypeAAAA && !isA) {
+					answers = append(answers, rr)
+				}
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	if legacy {
+		// legacy unicast queries expect the id and questions echoed back, and the cache flush bit
+		// clear, since a plain resolver would read it as part of the class (RFC 6762 6.7)
+		msg.Header.ID = query.Header.ID
+		msg.Questions = query.Questions
+		clearCacheFlush(msg.Answers)
+		clearCacheFlush(msg.Additionals)
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		fmt.Printf("mdns: Error packing response: %s\n", err.Error())
+		return
+	}
+	// unicast-response requests from other responders are answered by multicast, since other
+	// sockets sharing port 5353 on their host may receive the unicast instead of them
+	if legacy {
+		c.writeTo(packed, nil, src)
+	} else if iface, err := net.InterfaceByIndex(ifIndex); err == nil {
+		c.writeTo(packed, iface, c.group())
+	} else {
+		c.writeTo(packed, nil, c.group())
+	}
+}
+
+// browseName is the DNS-SD meta-query name used to enumerate service types
+func (r *Responder) browseName() string {
+	return fmt.Sprintf("_services._dns-sd._udp.%s", fqdn(strings.Trim(r.service.Domain, ".")))
+}
+
+func (r *Responder) browseRecord(ttl uint32) dnsmessage.Resource {
+	service, _, _ := r.names()
+	return dnsmessage.Resource{
+		Header: resourceHeader(r.browseName(), ttl, false),
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(service)},
+	}
+}
+
+func (r *Responder) ptrRecord(ttl uint32) dnsmessage.Resource {
+	r.mutex.Lock()
+	s := r.service
+	r.mutex.Unlock()
+	return dnsmessage.Resource{
+		Header: resourceHeader(serviceName(s.Service, s.Domain), ttl, false),
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(instanceName(s.Instance, s.Service, s.Domain))},
+	}
+}
+
+func (r *Responder) isSubtype(name string) bool {
+	r.mutex.Lock()
+	s := r.service
+	r.mutex.Unlock()
+	for _, subtype := range s.Subtypes {
+		if name == strings.ToLower(subtypeName(subtype, s.Service, s.Domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Responder) subtypeRecord(name string, ttl uint32) dnsmessage.Resource {
+	r.mutex.Lock()
+	s := r.service
+	r.mutex.Unlock()
+	return dnsmessage.Resource{
+		Header: resourceHeader(name, ttl, false),
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(instanceName(s.Instance, s.Service, s.Domain))},
+	}
+}
+
+func (r *Responder) serviceRecords(ttl uint32) []dnsmessage.Resource {
+	srv, txt := r.instanceRecords(ttl)
+	records := []dnsmessage.Resource{r.ptrRecord(ttl), srv, txt}
+	r.mutex.Lock()
+	s := r.service
+	r.mutex.Unlock()
+	for _, subtype := range s.Subtypes {
+		records = append(records, r.subtypeRecord(subtypeName(subtype, s.Service, s.Domain), ttl))
+	}
+	return records
+}
+
+func (r *Responder) instanceRecords(ttl uint32) (dnsmessage.Resource, dnsmessage.Resource) {
+	r.mutex.Lock()
+	s := r.service
+	r.mutex.Unlock()
+	instance := instanceName(s.Instance, s.Service, s.Domain)
+	host := fqdn(s.Host + "." + strings.Trim(s.Domain, "."))
+	srv := dnsmessage.Resource{
+		Header: resourceHeader(instance, ttl, true),
+		Body: &dnsmessage.SRVResource{
+			Priority: 0,
+			Weight:   0,
+			Port:     uint16(s.Port),
+			Target:   dnsmessage.MustNewName(host),
+		},
+	}
+	txt := dnsmessage.Resource{
+		Header: resourceHeader(instance, ttl, true),
+		Body:   &dnsmessage.TXTResource{TXT: txtStrings(s.Text)},
+	}
+	return srv, txt
+}
+
+// addressRecords returns A/AAAA records for the addresses on the interface a query arrived on,
+// or for every multicast interface if that is unknown.
+func (r *Responder) addressRecords(ifIndex int, ttl uint32) []dnsmessage.Resource {
+	r.mutex.Lock()
+	host := fqdn(r.service.Host + "." + strings.Trim(r.service.Domain, "."))
+	r.mutex.Unlock()
+
+	ifaces := r.ifaces
+	if iface, err := net.InterfaceByIndex(ifIndex); err == nil && ifIndex != 0 {
+		ifaces = []net.Interface{*iface}
+	}
+	records := make([]dnsmessage.Resource, 0)
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ip, _, err := net.ParseCIDR(addr.String())
+			if err != nil {
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				a := dnsmessage.AResource{}
+				copy(a.A[:], ip4)
+				records = append(records, dnsmessage.Resource{Header: resourceHeader(host, ttl, true), Body: &a})
+			} else {
+				aaaa := dnsmessage.AAAAResource{}
+				copy(aaaa.AAAA[:], ip.To16())
+				records = append(records, dnsmessage.Resource{Header: resourceHeader(host, ttl, true), Body: &aaaa})
+			}
+		}
+	}
+	return records
+}
+
+func clearCacheFlush(records []dnsmessage.Resource) {
+	for i := range records {
+		records[i].Header.Class &^= classCacheFlush
+	}
+}
+
+func resourceHeader(name string, ttl uint32, unique bool) dnsmessage.ResourceHeader {
+	class := dnsmessage.ClassINET
+	if unique {
+		class |= classCacheFlush
+	}
+	return dnsmessage.ResourceHeader{
+		Name:  dnsmessage.MustNewName(fqdn(name)),
+		Class: class,
+		TTL:   ttl,
+	}
+}
@@ -0,0 +1,140 @@
+package mdns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeConn hands the responder packets from the test, and passes on what it sends
+type fakeConn struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan bool
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{in: make(chan []byte, 16), out: make(chan []byte, 64), closed: make(chan bool)}
+}
+
+func (c *fakeConn) readFrom(b []byte) (int, int, net.Addr, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p), 0, &net.UDPAddr{IP: net.ParseIP("192.0.2.9"), Port: Port}, nil
+	case <-c.closed:
+		return 0, 0, nil, errors.New("closed")
+	}
+}
+
+func (c *fakeConn) writeTo(b []byte, iface *net.Interface, dst net.Addr) error {
+	select {
+	case c.out <- append([]byte(nil), b...):
+	default:
+	}
+	return nil
+}
+
+func (c *fakeConn) group() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: Port}
+}
+func (c *fakeConn) setReadDeadline(t time.Time) error { return nil }
+func (c *fakeConn) close() error                      { close(c.closed); return nil }
+
+// rivalProbe is the probe another host would send for our instance name, proposing port
+func rivalProbe(t *testing.T, service Service, port int) []byte {
+	service.Port = port
+	rival := NewResponder(service)
+	_, instance, _ := rival.names()
+	srv, txt := rival.instanceRecords(defaultTTL)
+	msg := dnsmessage.Message{
+		Questions:   []dnsmessage.Question{question(instance, dnsmessage.TypeALL, false)},
+		Authorities: []dnsmessage.Resource{srv, txt},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func TestProbeTiebreak(t *testing.T) {
+	service := Service{Instance: "node", Service: "_test._tcp", Domain: "local", Host: "node-host", Port: 2380, Text: []string{"a=1"}}
+	tests := []struct {
+		name      string
+		rivalPort int
+		wantLost  bool
+	}{
+		{name: "rival sorts later", rivalPort: 2381, wantLost: true},
+		{name: "rival sorts earlier", rivalPort: 2379},
+		{name: "our own probe", rivalPort: 2380},
+	}
+	for _, tt := range tests {
+		r := NewResponder(service)
+		// no real interfaces, so the host name proposes no address records
+		r.ifaces = []net.Interface{{Index: 0, Name: "fake"}}
+		conn := newFakeConn()
+		r.conns = []packetConn{conn}
+		r.wg.Add(1)
+		go r.serve(conn)
+
+		probes := 0
+		go func() {
+			for p := range conn.out {
+				var msg dnsmessage.Message
+				if msg.Unpack(p) == nil && !msg.Header.Response {
+					probes++
+					if probes == 1 {
+						// the rival starts probing at the same moment we do
+						conn.in <- rivalProbe(t, service, tt.rivalPort)
+					}
+				}
+			}
+		}()
+		start := time.Now()
+		err := r.probe()
+		elapsed := time.Since(start)
+		r.Shutdown()
+		close(conn.out)
+
+		if err != nil {
+			t.Errorf("%s: probe returned %s", tt.name, err.Error())
+		}
+		if r.Instance() != "node" {
+			t.Errorf("%s: renamed to '%s' with no answer from the rival", tt.name, r.Instance())
+		}
+		if lost := elapsed >= time.Second; lost != tt.wantLost {
+			t.Errorf("%s: probing took %s, want tiebreak lost %v", tt.name, elapsed.String(), tt.wantLost)
+		}
+	}
+}
+
+func TestCompareRecords(t *testing.T) {
+	a := func(ip string) dnsmessage.Resource {
+		body := dnsmessage.AResource{}
+		copy(body.A[:], net.ParseIP(ip).To4())
+		return dnsmessage.Resource{Header: resourceHeader("host.local", hostTTL, true), Body: &body}
+	}
+	txt := dnsmessage.Resource{Header: resourceHeader("host.local", hostTTL, false), Body: &dnsmessage.TXTResource{TXT: []string{"x"}}}
+	tests := []struct {
+		name string
+		a, b []dnsmessage.Resource
+		want int // sign
+	}{
+		// the example from RFC 6762 8.2
+		{name: "address bytes", a: []dnsmessage.Resource{a("169.254.99.200")}, b: []dnsmessage.Resource{a("169.254.200.50")}, want: -1},
+		{name: "identical", a: []dnsmessage.Resource{a("10.0.0.1"), txt}, b: []dnsmessage.Resource{txt, a("10.0.0.1")}, want: 0},
+		{name: "more records", a: []dnsmessage.Resource{a("10.0.0.1"), a("10.0.0.2")}, b: []dnsmessage.Resource{a("10.0.0.1")}, want: 1},
+		// A is type 1, so it sorts before TXT whatever the addresses
+		{name: "type first", a: []dnsmessage.Resource{a("255.255.255.255")}, b: []dnsmessage.Resource{txt}, want: -1},
+		{name: "sorted before comparing", a: []dnsmessage.Resource{a("10.0.0.9"), a("10.0.0.1")}, b: []dnsmessage.Resource{a("10.0.0.2"), a("10.0.0.3")}, want: -1},
+	}
+	for _, tt := range tests {
+		got := compareRecords(tt.a, tt.b)
+		if (got > 0) != (tt.want > 0) || (got < 0) != (tt.want < 0) {
+			t.Errorf("%s: compareRecords returned %d, want sign %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,7 +1,15 @@
 package main
 
-import "github.com/ScriptRock/peerdiscovery/client"
+import (
+	"github.com/ScriptRock/peerdiscovery/client"
+	"github.com/ScriptRock/peerdiscovery/discovery"
+	"os"
+)
 
 func main() {
-	client.Client()
+	if len(os.Args) > 1 && os.Args[1] == "serve-discovery" {
+		discovery.Server()
+	} else {
+		client.Client()
+	}
 }